@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// runRequest is the body of POST /api/v1/runs: the same request the websocket
+// receives, Input being base64 encoded, plus whether to wait for the result.
+type runRequest struct {
+	request
+	Wait bool
+}
+
+type runResult struct {
+	runStatus
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+}
+
+func newRunResult(r *run) runResult {
+	stdout, stderr := r.output()
+	return runResult{
+		runStatus: r.status(),
+		Stdout:    string(stdout),
+		Stderr:    string(stderr),
+	}
+}
+
+// apiHandler serves the REST API:
+//
+//	POST /api/v1/runs               start a run, and wait for it with "wait": true
+//	GET  /api/v1/runs/<id>          status, exit code, timings and output of a run
+//	GET  /api/v1/runs/<id>/events   its events as newline delimited JSON, from ?from=<seq>
+//	POST /api/v1/lint               the diagnostics of the code of an env, for editors
+//	GET  /api/v1/openapi.json       the OpenAPI description of all this
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "openapi.json":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPI)
+	case len(parts) == 1 && parts[0] == "lint":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		lintHandler(w, r)
+	case len(parts) == 1 && parts[0] == "runs":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		createRun(w, r)
+	case len(parts) == 2 && parts[0] == "runs":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		if run, ok := findRun(w, parts[1]); ok {
+			writeJSON(w, http.StatusOK, newRunResult(run))
+		}
+	case len(parts) == 3 && parts[0] == "runs" && parts[2] == "events":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		if run, ok := findRun(w, parts[1]); ok {
+			streamEvents(w, r, run)
+		}
+	default:
+		apiError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+	}
+}
+
+func createRun(w http.ResponseWriter, r *http.Request) {
+	req := runRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+		return
+	}
+	if err := req.check(); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	run := runs.start(req.request)
+	w.Header().Set("Location", "/api/v1/runs/"+run.ID)
+	if !req.Wait {
+		writeJSON(w, http.StatusCreated, newRunResult(run))
+		return
+	}
+	if !run.wait(r.Context().Done()) {
+		return
+	}
+	writeJSON(w, http.StatusOK, newRunResult(run))
+}
+
+// lintRequest is the body of POST /api/v1/lint.
+type lintRequest struct {
+	Env  string `json:"env"`
+	Code string `json:"code"`
+}
+
+func lintHandler(w http.ResponseWriter, r *http.Request) {
+	req := lintRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+		return
+	}
+	env, err := findEnv(req.Env)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, lintCode(env, req.Code))
+}
+
+func findRun(w http.ResponseWriter, ID string) (*run, bool) {
+	run, ok := runs.get(ID)
+	if !ok {
+		apiError(w, http.StatusNotFound, fmt.Errorf("invalid run '%s'", ID))
+	}
+	return run, ok
+}
+
+func streamEvents(w http.ResponseWriter, r *http.Request, run *run) {
+	seq := 0
+	if from := r.FormValue("from"); from != "" {
+		n, err := strconv.Atoi(from)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid sequence number '%s'", from))
+			return
+		}
+		seq = n
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		events, done, update := run.follow(seq)
+		for _, e := range events {
+			seq = e.Seq
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-update:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(buf, '\n'))
+}
+
+func apiError(w http.ResponseWriter, code int, err error) {
+	buf, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(buf, '\n'))
+}
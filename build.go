@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	stepRunning = "running"
+	stepCached  = "cached"
+	stepDone    = "done"
+	stepError   = "error"
+)
+
+// buildStep is the progress of one instruction of a Dockerfile being built.
+type buildStep struct {
+	Stage       string `json:"stage,omitempty"`
+	Step        int    `json:"step"`
+	Steps       int    `json:"steps"`
+	Instruction string `json:"instruction"`
+	Status      string `json:"status"`
+	DurationMs  int64  `json:"durationMs,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// imageInfo describes a built image, its layers listed from the newest.
+type imageInfo struct {
+	Name   string       `json:"name"`
+	Size   int64        `json:"size"`
+	Layers []imageLayer `json:"layers"`
+}
+
+type imageLayer struct {
+	ID        string `json:"id,omitempty"`
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy"`
+}
+
+// Lines of the plain progress output of BuildKit, each starting with the
+// number of the vertex it is about.
+var (
+	vertexPattern = regexp.MustCompile(`^#(\d+) \[(?:(\S+) )?(\d+)/(\d+)\] (.*)$`)
+	cachedPattern = regexp.MustCompile(`^#(\d+) CACHED$`)
+	donePattern   = regexp.MustCompile(`^#(\d+) DONE (\d+(?:\.\d+)?)s$`)
+	errorPattern  = regexp.MustCompile(`^#(\d+) ERROR:? ?(.*)$`)
+)
+
+// buildParser turns the build output into build events. Vertices which are
+// not a step of the Dockerfile, like loading the context, are left out.
+type buildParser struct {
+	steps map[string]*buildStep
+}
+
+func (p *buildParser) parse(line string) *buildStep {
+	if m := vertexPattern.FindStringSubmatch(line); m != nil {
+		step, _ := strconv.Atoi(m[3])
+		steps, _ := strconv.Atoi(m[4])
+		s := &buildStep{Stage: m[2], Step: step, Steps: steps, Instruction: m[5], Status: stepRunning}
+		p.steps[m[1]] = s
+		copied := *s
+		return &copied
+	}
+	var s *buildStep
+	if m := cachedPattern.FindStringSubmatch(line); m != nil {
+		if s = p.steps[m[1]]; s != nil {
+			s.Status = stepCached
+		}
+	} else if m := donePattern.FindStringSubmatch(line); m != nil {
+		if s = p.steps[m[1]]; s != nil && s.Status != stepCached {
+			seconds, _ := strconv.ParseFloat(m[2], 64)
+			s.Status = stepDone
+			s.DurationMs = int64(seconds * 1000)
+		} else {
+			s = nil
+		}
+	} else if m := errorPattern.FindStringSubmatch(line); m != nil {
+		if s = p.steps[m[1]]; s != nil {
+			s.Status = stepError
+			s.Error = m[2]
+		}
+	}
+	if s == nil {
+		return nil
+	}
+	copied := *s
+	return &copied
+}
+
+// buildImage builds the Dockerfile file of the run directory, mounted in the
+// Docker daemon container of the run, into image. The build output goes to
+// the run as stderr along with the progress of every step. It returns the
+// exit code of the build, which is killed when ctx is done.
+func buildImage(ctx context.Context, r *run, daemon, file, image string) (int, error) {
+	cmd := exec.CommandContext(ctx, conf.Docker, "exec", "-e", "DOCKER_BUILDKIT=1", daemon,
+		"docker", "build", "--progress=plain", "-f", "/dtc/"+file, "-t", image, "/dtc")
+	out, w := io.Pipe()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	parsed := make(chan struct{})
+	go func() {
+		defer close(parsed)
+		p := &buildParser{steps: map[string]*buildStep{}}
+		scanner := bufio.NewScanner(out)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			r.emit(event{Type: eventStderr, Data: []byte(line + "\n")})
+			if s := p.parse(line); s != nil {
+				r.emit(event{Type: eventBuild, Build: s})
+			}
+		}
+		io.Copy(io.Discard, out)
+	}()
+	err := cmd.Wait()
+	w.Close()
+	<-parsed
+	if ctx.Err() != nil {
+		return 137, nil
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return exit.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// inspectImage returns the size and history of image in the Docker daemon
+// container of a run.
+func inspectImage(daemon, image string) (*imageInfo, error) {
+	dockerIn := func(args ...string) (string, error) {
+		out, err := exec.Command(conf.Docker, append([]string{"exec", daemon, "docker"}, args...)...).Output()
+		if err != nil {
+			return "", fmt.Errorf("docker %s: %v", args[0], err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	size, err := dockerIn("image", "inspect", "--format", "{{ .Size }}", image)
+	if err != nil {
+		return nil, err
+	}
+	info := &imageInfo{Name: image, Layers: []imageLayer{}}
+	if info.Size, err = strconv.ParseInt(size, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid image size '%s'", size)
+	}
+	history, err := dockerIn("history", "--no-trunc", "--human=false", "--format", "{{ .ID }}\t{{ .Size }}\t{{ .CreatedBy }}", image)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(history, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		layer := imageLayer{CreatedBy: fields[2]}
+		if fields[0] != "<missing>" {
+			layer.ID = fields[0]
+		}
+		layer.Size, _ = strconv.ParseInt(fields[1], 10, 64)
+		info.Layers = append(info.Layers, layer)
+	}
+	return info, nil
+}
+
+// summary describes the image in a few lines, for the output of the run.
+func (info *imageInfo) summary() string {
+	lines := []string{fmt.Sprintf("Image: %s in %d layers", humanSize(info.Size), len(info.Layers))}
+	for _, l := range info.Layers {
+		createdBy := strings.TrimPrefix(strings.TrimSpace(l.CreatedBy), "/bin/sh -c #(nop) ")
+		if len(createdBy) > 60 {
+			createdBy = createdBy[:57] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%10s  %s", humanSize(l.Size), createdBy))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "kB", "MB", "GB"}
+	size, i := float64(n), 0
+	for size >= 1000 && i < len(units)-1 {
+		size /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", size, units[i])
+}
+
+// buildRun builds the code of r, a Dockerfile named file, in the Docker
+// daemon of the run, and reports the resulting image. It returns the exit
+// code of the build when it failed or was killed, and nil otherwise. The
+// build counts in the time the run is given.
+func buildRun(r *run, file string, lim limits) (*int, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := lim.timeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-r.cancelled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	image := runImage(r)
+	code, err := buildImage(ctx, r, daemonName(r), file, image)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-r.cancelled:
+		r.emit(event{Type: eventInfo, Message: "Killed: the run was cancelled"})
+		return &code, nil
+	default:
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		r.mu.Lock()
+		r.TimedOut = true
+		r.mu.Unlock()
+		r.emit(event{Type: eventInfo, Message: fmt.Sprintf("Killed: the run took more than %s", lim.Timeout)})
+		return &code, nil
+	}
+	if code != 0 {
+		r.emit(event{Type: eventInfo, Message: "The image could not be built"})
+		return &code, nil
+	}
+	info, err := inspectImage(daemonName(r), image)
+	if err != nil {
+		r.emit(event{Type: eventInfo, Message: fmt.Sprintf("Cannot inspect the image: %v", err)})
+		return nil, nil
+	}
+	r.emit(event{Type: eventImage, Message: info.summary(), Image: info})
+	return nil, nil
+}
+
+// runImage is the name of the image built by r.
+func runImage(r *run) string {
+	return "dtc-" + r.ID
+}
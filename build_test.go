@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildParser(t *testing.T) {
+	output := `#0 building with "default" instance using docker driver
+
+#1 [internal] load build definition from Dockerfile
+#1 transferring dockerfile: 121B done
+#1 DONE 0.0s
+
+#2 [internal] load metadata for docker.io/library/golang:1.21
+#2 DONE 1.2s
+
+#3 [build 1/3] FROM docker.io/library/golang:1.21@sha256:4a3c
+#3 CACHED
+
+#4 [build 2/3] COPY main.go .
+#4 DONE 0.1s
+
+#5 [build 3/3] RUN go build -o /app main.go
+#5 0.532 compiling
+#5 DONE 12.25s
+
+#6 [stage-1 1/2] FROM docker.io/library/alpine:3.20
+#6 DONE 0.0s
+
+#7 [stage-1 2/2] RUN apk add curl
+#7 0.301 ERROR: unable to select packages:
+#7 ERROR: process "/bin/sh -c apk add curl" did not complete successfully: exit code: 1
+
+#8 [3/3] RUN make
+#8 ERROR process "/bin/sh -c make" did not complete successfully
+
+#9 exporting to image
+#9 DONE 0.2s
+`
+	want := []buildStep{
+		{Stage: "build", Step: 1, Steps: 3, Instruction: "FROM docker.io/library/golang:1.21@sha256:4a3c", Status: stepRunning},
+		{Stage: "build", Step: 1, Steps: 3, Instruction: "FROM docker.io/library/golang:1.21@sha256:4a3c", Status: stepCached},
+		{Stage: "build", Step: 2, Steps: 3, Instruction: "COPY main.go .", Status: stepRunning},
+		{Stage: "build", Step: 2, Steps: 3, Instruction: "COPY main.go .", Status: stepDone, DurationMs: 100},
+		{Stage: "build", Step: 3, Steps: 3, Instruction: "RUN go build -o /app main.go", Status: stepRunning},
+		{Stage: "build", Step: 3, Steps: 3, Instruction: "RUN go build -o /app main.go", Status: stepDone, DurationMs: 12250},
+		{Stage: "stage-1", Step: 1, Steps: 2, Instruction: "FROM docker.io/library/alpine:3.20", Status: stepRunning},
+		{Stage: "stage-1", Step: 1, Steps: 2, Instruction: "FROM docker.io/library/alpine:3.20", Status: stepDone},
+		{Stage: "stage-1", Step: 2, Steps: 2, Instruction: "RUN apk add curl", Status: stepRunning},
+		{Stage: "stage-1", Step: 2, Steps: 2, Instruction: "RUN apk add curl", Status: stepError,
+			Error: `process "/bin/sh -c apk add curl" did not complete successfully: exit code: 1`},
+		{Step: 3, Steps: 3, Instruction: "RUN make", Status: stepRunning},
+		{Step: 3, Steps: 3, Instruction: "RUN make", Status: stepError, Error: `process "/bin/sh -c make" did not complete successfully`},
+	}
+	p := &buildParser{steps: map[string]*buildStep{}}
+	got := []buildStep{}
+	for _, line := range strings.Split(output, "\n") {
+		if s := p.parse(line); s != nil {
+			got = append(got, *s)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parse() =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestBuildParserCachedDone(t *testing.T) {
+	p := &buildParser{steps: map[string]*buildStep{}}
+	p.parse("#3 [1/2] FROM docker.io/library/alpine:3.20")
+	if s := p.parse("#3 CACHED"); s == nil || s.Status != stepCached {
+		t.Fatalf("parse(CACHED) = %+v, want a cached step", s)
+	}
+	if s := p.parse("#3 DONE 0.0s"); s != nil {
+		t.Errorf("parse(DONE) of a cached step = %+v, want nil", s)
+	}
+	if s := p.parse("#4 DONE 1.0s"); s != nil {
+		t.Errorf("parse(DONE) of an unknown vertex = %+v, want nil", s)
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1000, "1.0 kB"},
+		{7654321, "7.7 MB"},
+		{5000000000, "5.0 GB"},
+		{5000000000000, "5000.0 GB"},
+	}
+	for _, test := range tests {
+		if got := humanSize(test.n); got != test.want {
+			t.Errorf("humanSize(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheWarmTimeout is how long a command warming the build caches of an env
+// is given.
+const cacheWarmTimeout = 10 * time.Minute
+
+// cacheKind is a build cache runs can get, in a directory given by Vars.
+type cacheKind struct {
+	Mount string
+	Vars  map[string]string
+	// Warm fills the cache with what most runs need, before the samples of
+	// the env are run to add what they need.
+	Warm []string
+}
+
+var cacheKinds = map[string]cacheKind{
+	"go": {
+		Mount: "/opt/dtc/cache/go",
+		Vars:  map[string]string{"GOCACHE": "/opt/dtc/cache/go"},
+		Warm:  []string{"go", "build", "std"},
+	},
+	"ccache": {
+		Mount: "/opt/dtc/cache/ccache",
+		Vars:  map[string]string{"CCACHE_DIR": "/opt/dtc/cache/ccache"},
+	},
+	"pip": {
+		Mount: "/opt/dtc/cache/pip",
+		Vars:  map[string]string{"PIP_CACHE_DIR": "/opt/dtc/cache/pip"},
+	},
+}
+
+// validateCaches checks the caches of an env, the size of each by kind.
+func validateCaches(caches map[string]string) map[string]string {
+	problems := map[string]string{}
+	for _, kind := range sortedKeys(caches) {
+		if _, ok := cacheKinds[kind]; !ok {
+			problems[kind] = "is not one of go, ccache or pip"
+		} else if !memoryPattern.MatchString(caches[kind]) {
+			problems[kind] = fmt.Sprintf("'%s' is not a valid size, e.g. 1g", caches[kind])
+		}
+	}
+	return problems
+}
+
+// sizeBytes returns the number of bytes of a size matching memoryPattern.
+func sizeBytes(size string) int64 {
+	unit := int64(1)
+	switch strings.ToLower(size[len(size)-1:]) {
+	case "k":
+		unit = 1 << 10
+	case "m":
+		unit = 1 << 20
+	case "g":
+		unit = 1 << 30
+	}
+	n, _ := strconv.ParseInt(strings.TrimRight(size, "bkmgBKMG"), 10, 64)
+	return n * unit
+}
+
+// Statuses of the build caches.
+const (
+	cachesPending = "pending"
+	cachesWarming = "warming"
+	cachesReady   = "ready"
+	cachesFailed  = "failed"
+)
+
+// buildCaches are the build caches of an env version, shared by all its
+// runs. Only the server writes to them, warming them with the image of the
+// version and the samples of the env: every run gets them through volumes
+// of its own, which keep what the run writes apart and drop it once the run
+// is over, so that nothing of the code of a run reaches the others. Each
+// cache is then cut down to its size, removing the files used the least
+// recently first.
+type buildCaches struct {
+	env     env
+	version version
+	image   *image
+	mu      sync.Mutex
+	// dir holds a directory by kind of cache, once warm.
+	dir    string
+	status string
+	err    error
+}
+
+func newBuildCaches(l env, v version, img *image) *buildCaches {
+	c := &buildCaches{env: l, version: v, image: img}
+	c.setStatus(cachesPending, "", nil)
+	img.caches = c
+	return c
+}
+
+func (c *buildCaches) setStatus(status, dir string, err error) {
+	c.mu.Lock()
+	c.status, c.dir, c.err = status, dir, err
+	c.mu.Unlock()
+	c.image.mu.Lock()
+	c.image.Caches = status
+	c.image.notify()
+	c.image.mu.Unlock()
+}
+
+// ready returns the directory of the caches, if they are warm.
+func (c *buildCaches) ready() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dir, c.status == cachesReady
+}
+
+// warmedFile marks the caches whose warming completed.
+const warmedFile = ".warmed"
+
+// warm fills the caches, unless they already were with the same image, and
+// removes the caches warmed before. What it does is appended to the build
+// log of the image.
+func (c *buildCaches) warm() error {
+	name := c.env.ID
+	if c.version.ID != "" {
+		name += "-" + c.version.ID
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", c.image.status().Hash)
+	for _, kind := range sortedKeys(c.env.Caches) {
+		fmt.Fprintf(h, "%s=%s\x00", kind, c.env.Caches[kind])
+	}
+	dir := filepath.Join(conf.CachesDir, name+"-"+hex.EncodeToString(h.Sum(nil))[:12])
+	if _, err := os.Stat(filepath.Join(dir, warmedFile)); err == nil {
+		c.setStatus(cachesReady, dir, nil)
+		return nil
+	}
+	c.setStatus(cachesWarming, "", nil)
+	slog.Info("warming the build caches", "dir", dir, "image", c.image.Name)
+	err := c.fill(dir)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, warmedFile), nil, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(c.image, "Cannot warm %s: %v\n", dir, err)
+		c.setStatus(cachesFailed, "", err)
+		return err
+	}
+	c.setStatus(cachesReady, dir, nil)
+	removeStale(conf.CachesDir, name, dir)
+	return nil
+}
+
+// fill warms the caches in dir, then evicts what does not fit in them.
+func (c *buildCaches) fill(dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	mounts := []string{}
+	for _, kind := range sortedKeys(c.env.Caches) {
+		k := cacheKinds[kind]
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0777); err != nil {
+			return err
+		}
+		mounts = append(mounts, "-v", filepath.Join(dir, kind)+":"+k.Mount)
+		for _, v := range sortedKeys(k.Vars) {
+			mounts = append(mounts, "-e", v+"="+k.Vars[v])
+		}
+	}
+	if c.env.usesPackages(c.version) {
+		if args, err := packageMounts(c.env, c.version); err == nil {
+			mounts = append(mounts, args...)
+		}
+	}
+	for _, kind := range sortedKeys(c.env.Caches) {
+		if warm := cacheKinds[kind].Warm; len(warm) > 0 {
+			fmt.Fprintf(c.image, "Warming the %s cache with %s\n", kind, strings.Join(warm, " "))
+			if err := c.warmRun(mounts, "", "", warm, cacheWarmTimeout); err != nil {
+				return err
+			}
+		}
+	}
+	// The samples may well fail without their input, or on purpose: only
+	// what they compiled matters.
+	lim := c.env.Limits.or(conf.Limits)
+	for _, s := range c.env.Samples {
+		fmt.Fprintf(c.image, "Warming the caches with the sample %s\n", s.ID)
+		if err := c.warmSample(mounts, s, lim); err != nil {
+			fmt.Fprintf(c.image, "The sample %s failed: %v\n", s.ID, err)
+		}
+	}
+	for _, kind := range sortedKeys(c.env.Caches) {
+		if err := evict(filepath.Join(dir, kind), sizeBytes(c.env.Caches[kind])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmSample runs the sample s the way runs do, with its input if any.
+func (c *buildCaches) warmSample(mounts []string, s sample, lim limits) error {
+	code, err := ioutil.ReadFile(filepath.Join(c.env.path, s.File))
+	if err != nil {
+		return err
+	}
+	file, vars := c.env.File, map[string]string{}
+	if c.env.Entrypoint != nil {
+		if file, vars, err = c.env.Entrypoint.detect(string(code)); err != nil {
+			return err
+		}
+	}
+	dir, err := ioutil.TempDir(conf.Workdir, "dtc-warm-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, file), code, 0666); err != nil {
+		return err
+	}
+	if s.Dependencies != "" && c.env.usesPackages(c.version) {
+		data, err := ioutil.ReadFile(filepath.Join(c.env.path, s.Dependencies))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, packageManagers[c.env.Packages.Manager].File), data, 0666); err != nil {
+			return err
+		}
+	}
+	args := append([]string{"-v", dir + ":/dtc", "-e", "DTC_FILE=" + file}, mounts...)
+	for _, k := range sortedKeys(vars) {
+		args = append(args, "-e", k+"="+vars[k])
+	}
+	args = append(args, limitArgs(lim)...)
+	input := ""
+	if s.Input != "" {
+		input = filepath.Join(c.env.path, s.Input)
+	}
+	return c.warmRun(args, input, dir, nil, lim.timeout())
+}
+
+// warmRun runs cmd, or the command of the image if nil, in a container with
+// the flags args and no network, for at most timeout if not zero.
+func (c *buildCaches) warmRun(args []string, input, dir string, cmd []string, timeout time.Duration) error {
+	name := "dtc-warm-" + newID()
+	run := []string{"run", "--rm", "-i", "--name", name, "--network", "none"}
+	run = append(run, labelArgs("", time.Now())...)
+	run = append(run, args...)
+	run = append(run, c.image.Name)
+	run = append(run, cmd...)
+	command := exec.Command(conf.Docker, run...)
+	command.Stdout = c.image
+	command.Stderr = c.image
+	if input != "" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		command.Stdin = f
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			docker("container", "rm", "-f", name)
+		})
+		defer timer.Stop()
+	}
+	return command.Run()
+}
+
+// evict removes the files of dir used the least recently, by modification
+// time, until they add up to at most size bytes.
+func evict(dir string, size int64) error {
+	type entry struct {
+		path string
+		size int64
+		time time.Time
+	}
+	entries := []entry{}
+	total := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		entries = append(entries, entry{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	for _, e := range entries {
+		if total <= size {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			return err
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// cacheArgs returns the docker run flags giving r the build caches of its
+// version, if they are warm, and a function removing the volumes they go
+// through. Each volume is an overlay of the shared cache, which it does not
+// change, and of a directory of the run for what it writes.
+func cacheArgs(l env, v version, r *run) ([]string, func(), error) {
+	img, ok := images.get(l.ID, v.ID)
+	if !ok || img.caches == nil {
+		return nil, func() {}, nil
+	}
+	shared, ok := img.caches.ready()
+	if !ok {
+		return nil, func() {}, nil
+	}
+	dir, err := ioutil.TempDir(conf.Workdir, "dtc-cache-")
+	if err != nil {
+		return nil, nil, err
+	}
+	volumes := []string{}
+	remove := func() {
+		for _, name := range volumes {
+			if err := docker("volume", "rm", "-f", name); err != nil {
+				slog.Error("cannot remove the cache volume", "volume", name, "err", err)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+	args := []string{}
+	for _, kind := range sortedKeys(l.Caches) {
+		k := cacheKinds[kind]
+		upper, work := filepath.Join(dir, kind, "upper"), filepath.Join(dir, kind, "work")
+		for _, d := range []string{upper, work} {
+			if err := os.MkdirAll(d, 0777); err != nil {
+				remove()
+				return nil, nil, err
+			}
+		}
+		name := "dtc-run-" + r.ID + "-cache-" + kind
+		create := []string{"volume", "create", "--driver", "local", "--opt", "type=overlay", "--opt", "device=overlay",
+			"--opt", fmt.Sprintf("o=lowerdir=%s,upperdir=%s,workdir=%s", filepath.Join(shared, kind), upper, work)}
+		create = append(create, labelArgs(r.ID, r.Created)...)
+		if err := docker(append(create, name)...); err != nil {
+			remove()
+			return nil, nil, err
+		}
+		volumes = append(volumes, name)
+		args = append(args, "-v", name+":"+k.Mount)
+		for _, v := range sortedKeys(k.Vars) {
+			args = append(args, "-e", v+"="+k.Vars[v])
+		}
+	}
+	return args, remove, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The commands in this file are clients of a running server, so that code can
+// be run from a terminal and any editor.
+
+func defaultServer() string {
+	if server := os.Getenv("DTC_SERVER"); server != "" {
+		return server
+	}
+	return "http://localhost:8080"
+}
+
+func fetchEnvs(server string) ([]envStatus, error) {
+	resp, err := http.Get(strings.TrimSuffix(server, "/") + "/envs/")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	list := []envStatus{}
+	return list, json.NewDecoder(resp.Body).Decode(&list)
+}
+
+func fetchSample(server, envID, sampleID, part string) (string, error) {
+	u := strings.TrimSuffix(server, "/") + "/data/" + url.PathEscape(envID) + "/" + url.PathEscape(sampleID) + part
+	resp, err := http.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", resp.Status, content)
+	}
+	return string(content), nil
+}
+
+func listCommand(args []string) int {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	server := flags.String("server", defaultServer(), "URL of the server, or $DTC_SERVER")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	list, err := fetchEnvs(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, l := range list {
+		fmt.Printf("%s\t%s\t%s\n", l.ID, l.Name, l.Status)
+		for _, v := range l.Versions {
+			if v.ID == "" {
+				continue
+			}
+			def := ""
+			if v.Default {
+				def = " (default)"
+			}
+			fmt.Printf("  version %s\t%s%s\t%s\n", v.ID, v.Name, def, v.Status)
+		}
+		for _, s := range l.Samples {
+			fmt.Printf("  sample %s\t%s\n", s.ID, s.Name)
+		}
+	}
+	return 0
+}
+
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dtc run [flags] <file or directory>")
+		fmt.Fprintln(os.Stderr, "       dtc run [flags] -env <env> -sample <sample>")
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", defaultServer(), "URL of the server, or $DTC_SERVER")
+	envID := flags.String("env", "", "env to run the code in (default guessed from the file extension)")
+	versionID := flags.String("version", "", "version of the env (default its default version)")
+	sampleID := flags.String("sample", "", "run a sample of the env instead of local files")
+	main := flags.String("main", "", "file of a directory that holds the code (default the file name of the env)")
+	inputFile := flags.String("input", "", "file to use as standard input (default the input of the sample, or the piped standard input)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (flags.NArg() == 1) == (*sampleID != "") {
+		flags.Usage()
+		return 2
+	}
+	list, err := fetchEnvs(*server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req := request{Env: *envID, Version: *versionID}
+	input := []byte{}
+	if *sampleID != "" {
+		err = sampleRequest(*server, &req, *sampleID, list, &input)
+	} else {
+		err = localRequest(&req, flags.Arg(0), *main, list)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *inputFile != "" {
+		input, err = ioutil.ReadFile(*inputFile)
+	} else if info, serr := os.Stdin.Stat(); serr == nil && info.Mode()&os.ModeCharDevice == 0 && len(input) == 0 {
+		input, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Input = base64.StdEncoding.EncodeToString(input)
+	code, err := streamRun(*server, req, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return code
+}
+
+func sampleRequest(server string, req *request, sampleID string, list []envStatus, input *[]byte) error {
+	if req.Env == "" {
+		return fmt.Errorf("-env is required to run a sample")
+	}
+	for _, l := range list {
+		if l.ID != req.Env {
+			continue
+		}
+		s, err := l.findSample(sampleID)
+		if err != nil {
+			return err
+		}
+		req.Sample = s.ID
+		if req.Code, err = fetchSample(server, l.ID, s.ID, ""); err != nil {
+			return err
+		}
+		if s.Input != "" {
+			in, err := fetchSample(server, l.ID, s.ID, "/input")
+			*input = []byte(in)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid env '%s'", req.Env)
+}
+
+// localRequest reads the code to run from path. When path is a directory, its
+// main file is the code and every other file is sent along.
+func localRequest(req *request, path, main string, list []envStatus) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if req.Env == "" {
+		guess := path
+		if info.IsDir() {
+			guess = main
+		}
+		// Files with no extension, such as Makefile, and directories with
+		// no -main, would match any env with no extension either.
+		if filepath.Ext(guess) == "" {
+			return fmt.Errorf("cannot guess the env of %s from its extension, use -env", path)
+		}
+		for _, l := range list {
+			if l.File != "" && filepath.Ext(l.File) == filepath.Ext(guess) {
+				req.Env = l.ID
+				break
+			}
+		}
+		if req.Env == "" {
+			return fmt.Errorf("cannot guess the env of %s, use -env", path)
+		}
+	}
+	if !info.IsDir() {
+		code, err := ioutil.ReadFile(path)
+		req.Code = string(code)
+		return err
+	}
+	if main == "" {
+		for _, l := range list {
+			if l.ID == req.Env {
+				main = l.File
+			}
+		}
+		if main == "" {
+			return fmt.Errorf("the env '%s' has no fixed file name, use -main", req.Env)
+		}
+	}
+	found := false
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if filepath.ToSlash(rel) == main {
+			req.Code, found = string(content), true
+			return nil
+		}
+		req.Files = append(req.Files, requestFile{Name: filepath.ToSlash(rel), Content: string(content)})
+		return nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s has no %s file", path, main)
+	}
+	return err
+}
+
+// streamRun runs req on the server, copying its output to stdout and stderr,
+// and returns its exit code. If the connection drops, it attaches again to
+// the run and carries on from the last event received.
+func streamRun(server string, req request, stdout, stderr io.Writer) (int, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/") + "/run/")
+	if err != nil {
+		return 0, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	dialer := websocket.Dialer{Subprotocols: []string{protocolV2}}
+	var msg interface{} = req
+	runID, seq := "", 0
+	for attempt := 0; ; attempt++ {
+		conn, _, err := dialer.Dial(u.String(), nil)
+		if err != nil {
+			if runID == "" || attempt >= 10 {
+				return 0, err
+			}
+			time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+			continue
+		}
+		if err := conn.WriteJSON(msg); err != nil {
+			conn.Close()
+			return 0, err
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			hello := attachedMessage{}
+			if json.Unmarshal(data, &hello) == nil && hello.Type == "run" {
+				runID, attempt = hello.ID, 0
+				continue
+			}
+			e := event{}
+			if err := json.Unmarshal(data, &e); err != nil {
+				conn.Close()
+				return 0, err
+			}
+			if e.Seq > 0 {
+				seq = e.Seq
+			}
+			switch e.Type {
+			case eventStdout:
+				stdout.Write(e.text())
+			case eventStderr:
+				stderr.Write(e.text())
+			case eventInfo:
+				fmt.Fprintln(stderr, e.Message)
+			case eventError:
+				conn.Close()
+				return 0, fmt.Errorf("%s", e.Message)
+			case eventExit:
+				conn.Close()
+				return *e.ExitCode, nil
+			}
+		}
+		conn.Close()
+		if runID == "" {
+			return 0, fmt.Errorf("connection lost before the run started")
+		}
+		msg = runMessage{Attach: runID, Seq: seq}
+	}
+}
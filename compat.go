@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file maps the submission APIs of Judge0 and Piston onto runs, so that
+// scripts written against them can use this server instead. Only running code
+// is supported: memory is not measured and there is no separate compile step.
+
+func findPiston(language, versionID string) (env, version, error) {
+	for _, l := range envs {
+		for _, name := range l.Compat.Piston {
+			if name != language {
+				continue
+			}
+			if versionID == "" || versionID == "*" {
+				v, err := l.findVersion("")
+				return l, v, err
+			}
+			for _, v := range l.versions() {
+				if v.ID == versionID || (v.ID != "" && strings.HasPrefix(versionID, v.ID+".")) {
+					return l, v, nil
+				}
+			}
+		}
+	}
+	return env{}, version{}, fmt.Errorf("%s-%s runtime is unknown", language, versionID)
+}
+
+func findJudge0(ID int) (env, version, error) {
+	for _, l := range envs {
+		if versionID, ok := l.Compat.Judge0[ID]; ok {
+			v, err := l.findVersion(versionID)
+			return l, v, err
+		}
+	}
+	return env{}, version{}, fmt.Errorf("language with id %d doesn't exist", ID)
+}
+
+// sortedJudge0 returns the Judge0 language IDs of judge0 in order.
+func sortedJudge0(judge0 map[int]string) []int {
+	IDs := make([]int, 0, len(judge0))
+	for ID := range judge0 {
+		IDs = append(IDs, ID)
+	}
+	sort.Ints(IDs)
+	return IDs
+}
+
+type judge0Submission struct {
+	SourceCode     string  `json:"source_code"`
+	LanguageID     int     `json:"language_id"`
+	Stdin          string  `json:"stdin"`
+	ExpectedOutput *string `json:"expected_output"`
+}
+
+type judge0Status struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+}
+
+type judge0Language struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type judge0Result struct {
+	Token         string       `json:"token"`
+	Stdout        *string      `json:"stdout"`
+	Stderr        *string      `json:"stderr"`
+	CompileOutput *string      `json:"compile_output"`
+	Message       *string      `json:"message"`
+	ExitCode      *int         `json:"exit_code"`
+	Status        judge0Status `json:"status"`
+	Time          *string      `json:"time"`
+	Memory        *int         `json:"memory"`
+}
+
+var judge0Statuses = map[int]string{
+	1:  "In Queue",
+	2:  "Processing",
+	3:  "Accepted",
+	4:  "Wrong Answer",
+	5:  "Time Limit Exceeded",
+	7:  "Runtime Error (SIGSEGV)",
+	8:  "Runtime Error (SIGXFSZ)",
+	9:  "Runtime Error (SIGFPE)",
+	10: "Runtime Error (SIGABRT)",
+	11: "Runtime Error (NZEC)",
+	12: "Runtime Error (Other)",
+	13: "Internal Error",
+}
+
+// judge0Expected holds the expected output of the submissions that gave one,
+// by token, for as long as their run is kept.
+var judge0Expected = struct {
+	sync.Mutex
+	outputs map[string]string
+}{outputs: map[string]string{}}
+
+// judge0Handler serves POST /submissions, GET /submissions/<token> and
+// GET /languages the way Judge0 does, including the wait and base64_encoded
+// query parameters.
+func judge0Handler(w http.ResponseWriter, r *http.Request) {
+	encoded := r.URL.Query().Get("base64_encoded") == "true"
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "languages":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		languages := []judge0Language{}
+		for _, l := range envs {
+			for _, ID := range sortedJudge0(l.Compat.Judge0) {
+				if v, err := l.findVersion(l.Compat.Judge0[ID]); err == nil {
+					languages = append(languages, judge0Language{ID: ID, Name: v.Name})
+				}
+			}
+		}
+		sort.Slice(languages, func(i, j int) bool {
+			return languages[i].ID < languages[j].ID
+		})
+		writeJSON(w, http.StatusOK, languages)
+	case len(parts) == 1 && parts[0] == "submissions":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		createSubmission(w, r, encoded)
+	case len(parts) == 2 && parts[0] == "submissions":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		run, ok := runs.get(parts[1])
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "", "message": "Not Found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, newJudge0Result(run, encoded))
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "", "message": "Not Found"})
+	}
+}
+
+func createSubmission(w http.ResponseWriter, r *http.Request, encoded bool) {
+	sub := judge0Submission{}
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	l, v, err := findJudge0(sub.LanguageID)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string][]string{"language_id": {err.Error()}})
+		return
+	}
+	code, stdin := sub.SourceCode, sub.Stdin
+	if encoded {
+		code, err = decodeBase64(code)
+		if err == nil {
+			stdin, err = decodeBase64(stdin)
+		}
+		if err == nil && sub.ExpectedOutput != nil {
+			var expected string
+			expected, err = decodeBase64(*sub.ExpectedOutput)
+			sub.ExpectedOutput = &expected
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	req := request{
+		Env:     l.ID,
+		Version: v.ID,
+		Code:    code,
+		Input:   base64.StdEncoding.EncodeToString([]byte(stdin)),
+	}
+	if err := req.check(); err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string][]string{"source_code": {err.Error()}})
+		return
+	}
+	run := runs.start(req)
+	if sub.ExpectedOutput != nil {
+		judge0Expected.Lock()
+		judge0Expected.outputs[run.ID] = *sub.ExpectedOutput
+		judge0Expected.Unlock()
+		go func() {
+			run.wait(nil)
+			time.AfterFunc(runRetention, func() {
+				judge0Expected.Lock()
+				delete(judge0Expected.outputs, run.ID)
+				judge0Expected.Unlock()
+			})
+		}()
+	}
+	if r.URL.Query().Get("wait") != "true" {
+		writeJSON(w, http.StatusCreated, map[string]string{"token": run.ID})
+		return
+	}
+	if !run.wait(r.Context().Done()) {
+		return
+	}
+	writeJSON(w, http.StatusCreated, newJudge0Result(run, encoded))
+}
+
+func newJudge0Result(r *run, encoded bool) judge0Result {
+	status := r.status()
+	res := judge0Result{Token: status.ID}
+	text := func(s string) *string {
+		if encoded {
+			s = base64.StdEncoding.EncodeToString([]byte(s))
+		}
+		return &s
+	}
+	switch status.Status {
+	case runPending:
+		res.Status.ID = 1
+	case runRunning:
+		res.Status.ID = 2
+	case runFailed:
+		res.Status.ID = 13
+		res.Message = text(status.Error)
+	case runDone:
+		stdout, stderr := r.output()
+		res.Stdout, res.Stderr = text(string(stdout)), text(string(stderr))
+		res.ExitCode = status.ExitCode
+		seconds := strconv.FormatFloat(float64(status.DurationMs)/1000, 'f', 3, 64)
+		res.Time = &seconds
+		judge0Expected.Lock()
+		expected, checked := judge0Expected.outputs[status.ID]
+		judge0Expected.Unlock()
+		switch code := *status.ExitCode; {
+		case status.TimedOut:
+			res.Status.ID = 5
+		case code == 0 && checked && strings.TrimRight(string(stdout), " \n") != strings.TrimRight(expected, " \n"):
+			res.Status.ID = 4
+		case code == 0:
+			res.Status.ID = 3
+		case code == 128+11:
+			res.Status.ID = 7
+		case code == 128+25:
+			res.Status.ID = 8
+		case code == 128+8:
+			res.Status.ID = 9
+		case code == 128+6:
+			res.Status.ID = 10
+		case code > 128:
+			res.Status.ID = 12
+		default:
+			res.Status.ID = 11
+		}
+	}
+	res.Status.Description = judge0Statuses[res.Status.ID]
+	return res
+}
+
+func decodeBase64(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+type pistonFile struct {
+	Name     string `json:"name"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+type pistonRequest struct {
+	Language string       `json:"language"`
+	Version  string       `json:"version"`
+	Files    []pistonFile `json:"files"`
+	Stdin    string       `json:"stdin"`
+}
+
+type pistonStage struct {
+	Stdout string  `json:"stdout"`
+	Stderr string  `json:"stderr"`
+	Output string  `json:"output"`
+	Code   *int    `json:"code"`
+	Signal *string `json:"signal"`
+}
+
+type pistonResult struct {
+	Language string      `json:"language"`
+	Version  string      `json:"version"`
+	Run      pistonStage `json:"run"`
+}
+
+type pistonRuntime struct {
+	Language string   `json:"language"`
+	Version  string   `json:"version"`
+	Aliases  []string `json:"aliases"`
+}
+
+// pistonHandler serves POST /api/v2/execute and GET /api/v2/runtimes the way
+// Piston does. The first file is the code, the others are written next to it.
+func pistonHandler(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/api/v2/") {
+	case "runtimes":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		runtimes := []pistonRuntime{}
+		for _, l := range envs {
+			if len(l.Compat.Piston) == 0 {
+				continue
+			}
+			for _, v := range l.versions() {
+				runtimes = append(runtimes, pistonRuntime{
+					Language: l.Compat.Piston[0],
+					Version:  pistonVersion(v),
+					Aliases:  l.Compat.Piston[1:],
+				})
+			}
+		}
+		writeJSON(w, http.StatusOK, runtimes)
+	case "execute":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		execute(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not Found"})
+	}
+}
+
+func pistonVersion(v version) string {
+	if v.ID == "" {
+		return "*"
+	}
+	return v.ID
+}
+
+func execute(w http.ResponseWriter, r *http.Request) {
+	preq := pistonRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&preq); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	l, v, err := findPiston(preq.Language, preq.Version)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	if len(preq.Files) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "files is required as an array"})
+		return
+	}
+	req := request{
+		Env:     l.ID,
+		Version: v.ID,
+		Input:   base64.StdEncoding.EncodeToString([]byte(preq.Stdin)),
+	}
+	for i, f := range preq.Files {
+		content, err := decodePistonFile(f)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		if i == 0 {
+			req.Code = content
+			continue
+		}
+		req.Files = append(req.Files, requestFile{Name: f.Name, Content: content})
+	}
+	if err := req.check(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	run := runs.start(req)
+	if !run.wait(r.Context().Done()) {
+		return
+	}
+	status := run.status()
+	if status.ExitCode == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": status.Error})
+		return
+	}
+	res := pistonResult{Language: preq.Language, Version: pistonVersion(v)}
+	events, _, _ := run.follow(0)
+	output := []byte{}
+	for _, e := range events {
+		if e.Type == eventStdout || e.Type == eventStderr {
+			output = append(output, e.text()...)
+		}
+	}
+	stdout, stderr := run.output()
+	res.Run.Stdout, res.Run.Stderr, res.Run.Output = string(stdout), string(stderr), string(output)
+	res.Run.Code = status.ExitCode
+	if status.TimedOut || *status.ExitCode == 128+9 {
+		signal := "SIGKILL"
+		res.Run.Code, res.Run.Signal = nil, &signal
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func decodePistonFile(f pistonFile) (string, error) {
+	switch f.Encoding {
+	case "", "utf8":
+		return f.Content, nil
+	case "base64":
+		return decodeBase64(f.Content)
+	case "hex":
+		b, err := hex.DecodeString(f.Content)
+		return string(b), err
+	}
+	return "", fmt.Errorf("encoding must be one of utf8, base64, hex, got '%s'", f.Encoding)
+}
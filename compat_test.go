@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func TestJudge0ResultStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   string
+		exitCode int
+		timedOut bool
+		expected *string
+		id       int
+	}{
+		{"in queue", runPending, 0, false, nil, 1},
+		{"processing", runRunning, 0, false, nil, 2},
+		{"internal error", runFailed, 0, false, nil, 13},
+		{"accepted", runDone, 0, false, nil, 3},
+		{"expected output", runDone, 0, false, strPtr("hi"), 3},
+		{"expected output with trailing spaces", runDone, 0, false, strPtr("hi \n\n"), 3},
+		{"wrong answer", runDone, 0, false, strPtr("bye"), 4},
+		{"wrong answer with leading space", runDone, 0, false, strPtr(" hi"), 4},
+		{"time limit", runDone, 137, true, nil, 5},
+		{"time limit over wrong answer", runDone, 0, true, strPtr("bye"), 5},
+		{"segmentation fault", runDone, 139, false, nil, 7},
+		{"file size", runDone, 153, false, nil, 8},
+		{"floating point", runDone, 136, false, nil, 9},
+		{"abort", runDone, 134, false, nil, 10},
+		{"exit code", runDone, 1, false, nil, 11},
+		{"exit code over wrong answer", runDone, 2, false, strPtr("bye"), 11},
+		{"killed", runDone, 137, false, nil, 12},
+	}
+	for _, test := range tests {
+		r := &run{update: make(chan struct{}), cancelled: make(chan struct{}), truncated: make(chan struct{})}
+		r.runStatus = runStatus{ID: "judge0-" + test.name, Status: test.status, TimedOut: test.timedOut, DurationMs: 1234}
+		if test.status == runDone {
+			code := test.exitCode
+			r.ExitCode = &code
+		}
+		if test.status == runFailed {
+			r.Error = "the image is not ready"
+		}
+		r.emit(event{Type: eventStdout, Data: []byte("hi\n")})
+		if test.expected != nil {
+			judge0Expected.Lock()
+			judge0Expected.outputs[r.ID] = *test.expected
+			judge0Expected.Unlock()
+		}
+		res := newJudge0Result(r, false)
+		judge0Expected.Lock()
+		delete(judge0Expected.outputs, r.ID)
+		judge0Expected.Unlock()
+		if res.Status.ID != test.id || res.Status.Description != judge0Statuses[test.id] {
+			t.Errorf("%s: status = %d %q, want %d %q", test.name, res.Status.ID, res.Status.Description, test.id, judge0Statuses[test.id])
+		}
+		switch test.status {
+		case runDone:
+			if res.Stdout == nil || *res.Stdout != "hi\n" || res.Time == nil || *res.Time != "1.234" || res.ExitCode == nil || *res.ExitCode != test.exitCode {
+				t.Errorf("%s: the result of the run is missing", test.name)
+			}
+		case runFailed:
+			if res.Message == nil || *res.Message != "the image is not ready" {
+				t.Errorf("%s: message = %v, want the error of the run", test.name, res.Message)
+			}
+		default:
+			if res.Stdout != nil || res.ExitCode != nil || res.Time != nil {
+				t.Errorf("%s: a run not over has a result", test.name)
+			}
+		}
+	}
+}
+
+func TestJudge0ResultEncoded(t *testing.T) {
+	r := &run{update: make(chan struct{}), cancelled: make(chan struct{}), truncated: make(chan struct{})}
+	code := 1
+	r.runStatus = runStatus{ID: "encoded", Status: runDone, ExitCode: &code}
+	r.emit(event{Type: eventStdout, Data: []byte("hi\n")})
+	r.emit(event{Type: eventStderr, Data: []byte("oops\n")})
+	res := newJudge0Result(r, true)
+	if res.Stdout == nil || *res.Stdout != "aGkK" || res.Stderr == nil || *res.Stderr != "b29wcwo=" {
+		t.Errorf("stdout, stderr = %v, %v, want them in base64", res.Stdout, res.Stderr)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// composeProject is the name of the Compose project of a run, alone in its
+// Docker daemon.
+const composeProject = "dtc"
+
+// composeCommand is the command of the runs of a Compose env: it brings the
+// services of file up, builds them if need be, and stops them all once one
+// exits. Everything goes away with the Docker daemon of the run afterwards,
+// whether it completed or was killed.
+func composeCommand(file string) []string {
+	return []string{"docker", "compose", "-p", composeProject, "--project-directory", "/dtc",
+		"-f", "/dtc/" + file, "up", "--build", "--no-color", "--abort-on-container-exit"}
+}
+
+// servicePattern matches the lines Compose prints for the services, prefixed
+// with the name of their container: the service and its index.
+var servicePattern = regexp.MustCompile(`^(\S+?)(?:-\d+)?\s+\| ?(.*)$`)
+
+// streamServices emits the output of Compose line by line as events of typ,
+// the lines logged by a service tagged with it and the others as they are.
+func streamServices(r *run, typ string, rd io.Reader) error {
+	br := bufio.NewReader(rd)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			e := event{Type: typ, Data: []byte(line)}
+			if m := servicePattern.FindStringSubmatch(strings.TrimSuffix(line, "\n")); m != nil {
+				e.Service, e.Data = m[1], []byte(m[2]+"\n")
+			}
+			r.emit(e)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStreamServices(t *testing.T) {
+	tests := []struct {
+		line    string
+		service string
+		data    string
+	}{
+		{"web-1  | hello\n", "web", "hello\n"},
+		{"db-1 |ready\n", "db", "ready\n"},
+		{"my-app-2  | x\n", "my-app", "x\n"},
+		{"web-1  | a | b\n", "web", "a | b\n"},
+		{"web-1  | \n", "web", "\n"},
+		{"Attaching to web-1\n", "", "Attaching to web-1\n"},
+		{" Container dtc-web-1  Started\n", "", " Container dtc-web-1  Started\n"},
+		{"web-1 exited with code 0\n", "", "web-1 exited with code 0\n"},
+		{"web  | x", "web", "x\n"},
+	}
+	var output string
+	for _, test := range tests {
+		output += test.line
+	}
+	r := &run{update: make(chan struct{}), cancelled: make(chan struct{}), truncated: make(chan struct{})}
+	if err := streamServices(r, eventStdout, strings.NewReader(output)); err != nil {
+		t.Fatalf("streamServices() = %v", err)
+	}
+	if len(r.events) != len(tests) {
+		t.Fatalf("streamServices() emitted %d events, want %d", len(r.events), len(tests))
+	}
+	for i, test := range tests {
+		e := r.events[i]
+		if e.Type != eventStdout || e.Service != test.service || string(e.Data) != test.data {
+			t.Errorf("%q: event = %s %q %q, want %s %q %q", test.line, e.Type, e.Service, e.Data, eventStdout, test.service, test.data)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the settings of the server. Each one can be given, from the
+// lowest precedence to the highest, in the config file, in a DTC_*
+// environment variable or as a flag: the setting grpc-listen is the flag
+// -grpc-listen, the variable DTC_GRPC_LISTEN and grpc_listen in the file,
+// and limits-memory is memory in the [limits] section of the file.
+type config struct {
+	Listen     string
+	GRPCListen string
+	Paths      envPaths
+	Workdir    string
+	Docker     string
+	// ShutdownTimeout is how long runs are given to finish when the server
+	// stops.
+	ShutdownTimeout time.Duration
+	// ReaperInterval is how often leftovers of runs are looked for, and
+	// ReaperAge how old they must be to be removed.
+	ReaperInterval time.Duration
+	ReaperAge      time.Duration
+	// EgressImage is the image of the egress proxies, which runs dtc, and
+	// EgressRecord has the egress proxies of replay envs record the fixtures
+	// of the samples instead.
+	EgressImage  string
+	EgressRecord bool
+	// PackagesDir holds the package caches of the envs, shared with the
+	// Docker daemon like Workdir.
+	PackagesDir string
+	// CachesDir holds the build caches of the envs, shared with the Docker
+	// daemon like Workdir.
+	CachesDir string
+	// ResultsSize is how much output the results of the runs of cacheable
+	// envs can add up to, none being kept if zero.
+	ResultsSize string
+	// AdminToken is the bearer token the requests to /admin/ must give, the
+	// admin endpoints being disabled if empty.
+	AdminToken string
+	// Limits apply to the envs which do not set their own.
+	Limits    limits
+	LogLevel  string
+	LogFormat string
+}
+
+var conf = config{
+	Listen:          ":8080",
+	GRPCListen:      ":9090",
+	Paths:           defaultPaths,
+	Workdir:         "/tmp/dtc",
+	Docker:          "docker",
+	ShutdownTimeout: 30 * time.Second,
+	ReaperInterval:  10 * time.Minute,
+	ReaperAge:       time.Hour,
+	EgressImage:     "docker-teaches-code",
+	PackagesDir:     "/tmp/dtc/packages",
+	CachesDir:       "/tmp/dtc/caches",
+	ResultsSize:     "64m",
+	Limits:          limits{Output: "1m"},
+	LogLevel:        "info",
+	LogFormat:       "text",
+}
+
+// defaultConfigFile is read when no config file is given, if it exists.
+const defaultConfigFile = "dtc.toml"
+
+// configSections are the sections of the config file, which prefix the
+// names of their settings.
+var configSections = []string{"admin", "caches", "egress", "limits", "log", "packages", "reaper", "results"}
+
+func (c *config) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&c.Listen, "listen", c.Listen, "address of the HTTP server")
+	flags.StringVar(&c.GRPCListen, "grpc-listen", c.GRPCListen, "address of the gRPC server, none if empty")
+	flags.StringVar(&c.Paths.Front, "front", c.Paths.Front, "directory of the front end")
+	flags.StringVar(&c.Paths.Envs, "envs", c.Paths.Envs, "directory of the envs")
+	flags.StringVar(&c.Paths.Templates, "templates", c.Paths.Templates, "directory of the env templates")
+	flags.StringVar(&c.Workdir, "workdir", c.Workdir, "directory the code of the runs is written to, shared with the Docker daemon")
+	flags.StringVar(&c.Docker, "docker", c.Docker, "Docker compatible command that builds images and runs containers")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long runs are given to finish when the server stops")
+	flags.StringVar(&c.EgressImage, "egress-image", c.EgressImage, "image of the egress proxies of the runs, running dtc")
+	flags.BoolVar(&c.EgressRecord, "egress-record", c.EgressRecord, "record the fixtures of the samples of replay envs from the network, to write them")
+	flags.StringVar(&c.PackagesDir, "packages-dir", c.PackagesDir, "directory of the package caches of the envs, shared with the Docker daemon")
+	flags.StringVar(&c.CachesDir, "caches-dir", c.CachesDir, "directory of the build caches of the envs, shared with the Docker daemon")
+	flags.StringVar(&c.ResultsSize, "results-size", c.ResultsSize, "how much output the results replayed for identical runs of cacheable envs can add up to, 0 to disable")
+	flags.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token of the admin endpoints under /admin/, disabled if empty")
+	flags.StringVar(&c.Limits.Memory, "limits-memory", c.Limits.Memory, "default memory limit of the runs")
+	flags.StringVar(&c.Limits.CPUs, "limits-cpus", c.Limits.CPUs, "default number of CPUs of the runs")
+	flags.IntVar(&c.Limits.PIDs, "limits-pids", c.Limits.PIDs, "default limit of processes of the runs")
+	flags.StringVar(&c.Limits.Timeout, "limits-timeout", c.Limits.Timeout, "default time after which runs are killed")
+	flags.StringVar(&c.Limits.Output, "limits-output", c.Limits.Output, "default amount of output after which runs are killed, none if 0")
+	flags.DurationVar(&c.ReaperInterval, "reaper-interval", c.ReaperInterval, "how often leftover containers, images and workspaces are removed, only at startup if zero")
+	flags.DurationVar(&c.ReaperAge, "reaper-age", c.ReaperAge, "age from which leftovers of runs are removed")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "debug, info, warn or error")
+	flags.StringVar(&c.LogFormat, "log-format", c.LogFormat, "text or json")
+	return flags
+}
+
+// loadConfig sets conf from the config file, the environment and args, and
+// returns where each setting comes from.
+func loadConfig(name string, args []string) (map[string]string, error) {
+	flags := conf.flagSet(name)
+	path := flags.String("config", os.Getenv("DTC_CONFIG"), "TOML file of settings (default "+defaultConfigFile+" if it exists), or $DTC_CONFIG")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+	sources := map[string]string{}
+	flags.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = "default"
+	})
+	flags.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	delete(sources, "config")
+	set := func(name, value, source string) error {
+		if sources[name] == "flag" {
+			return nil
+		}
+		if err := flags.Set(name, value); err != nil {
+			return err
+		}
+		sources[name] = source
+		return nil
+	}
+	file := *path
+	if file == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			file = defaultConfigFile
+		}
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%v", file, err)
+		}
+		for _, e := range entries {
+			name := strings.Replace(strings.Replace(e.Key, ".", "-", -1), "_", "-", -1)
+			if _, ok := sources[name]; !ok {
+				return nil, fmt.Errorf("%s:%d: unknown setting '%s'", file, e.Line, e.Key)
+			}
+			if err := set(name, e.Value, file); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", file, e.Line, e.Key, err)
+			}
+		}
+	}
+	for _, name := range sortedKeys(sources) {
+		variable := "DTC_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+		if value, ok := os.LookupEnv(variable); ok {
+			if err := set(name, value, "$"+variable); err != nil {
+				return nil, fmt.Errorf("$%s: %v", variable, err)
+			}
+		}
+	}
+	return sources, conf.check()
+}
+
+func (c config) check() error {
+	problems := map[string]string{}
+	for k, msg := range c.Limits.validate() {
+		problems["limits-"+k] = msg
+	}
+	if c.Listen == "" {
+		problems["listen"] = "must not be empty"
+	}
+	if c.ReaperAge <= 0 {
+		problems["reaper-age"] = "must be positive"
+	}
+	if c.Docker == "" {
+		problems["docker"] = "must not be empty"
+	}
+	if !memoryPattern.MatchString(c.ResultsSize) {
+		problems["results-size"] = fmt.Sprintf("'%s' is not a valid size, e.g. 64m", c.ResultsSize)
+	}
+	if c.CachesDir == "" {
+		problems["caches-dir"] = "must not be empty"
+	}
+	if c.PackagesDir == "" {
+		problems["packages-dir"] = "must not be empty"
+	}
+	if c.EgressImage == "" {
+		problems["egress-image"] = "must not be empty"
+	}
+	if _, err := logLevel(c.LogLevel); err != nil {
+		problems["log-level"] = err.Error()
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		problems["log-format"] = fmt.Sprintf("'%s' is neither text nor json", c.LogFormat)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msgs := []string{}
+	for _, k := range sortedKeys(problems) {
+		msgs = append(msgs, k+": "+problems[k])
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+}
+
+func logLevel(name string) (slog.Level, error) {
+	switch name {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("'%s' is not one of debug, info, warn or error", name)
+}
+
+// setupLogging makes the default logger follow conf.
+func setupLogging() {
+	level, _ := logLevel(conf.LogLevel)
+	opts := &slog.HandlerOptions{Level: level}
+	if conf.LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	}
+}
+
+type tomlEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// parseTOML reads the subset of TOML the config file needs: comments,
+// [section] headers and key = value pairs whose value is a string, an integer
+// or a boolean. Keys are returned prefixed by their section and a dot.
+func parseTOML(data string) ([]tomlEntry, error) {
+	entries := []tomlEntry{}
+	section := ""
+	for i, line := range strings.Split(data, "\n") {
+		n := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end := strings.Index(line, "]")
+			if end < 0 || !tomlComment(line[end+1:]) {
+				return nil, fmt.Errorf("%d: invalid section header", n)
+			}
+			section = strings.TrimSpace(line[1:end])
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+		if key == "" || value == "" {
+			return nil, fmt.Errorf("%d: expected key = value", n)
+		}
+		switch value[0] {
+		case '"':
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil || !tomlComment(value[len(quoted):]) {
+				return nil, fmt.Errorf("%d: invalid string", n)
+			}
+			value, _ = strconv.Unquote(quoted)
+		case '\'':
+			end := strings.Index(value[1:], "'")
+			if end < 0 || !tomlComment(value[end+2:]) {
+				return nil, fmt.Errorf("%d: invalid string", n)
+			}
+			value = value[1 : end+1]
+		default:
+			if i := strings.Index(value, "#"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil && value != "true" && value != "false" {
+				return nil, fmt.Errorf("%d: '%s' is not a string, an integer or a boolean", n, value)
+			}
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		entries = append(entries, tomlEntry{key, value, n})
+	}
+	return entries, nil
+}
+
+// tomlComment tells whether rest, what follows a value, is only a comment.
+func tomlComment(rest string) bool {
+	rest = strings.TrimSpace(rest)
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
+
+// configCommand prints the settings the server would run with, as a config
+// file, along with where each comes from.
+func configCommand(args []string) int {
+	sources, err := loadConfig("config", args)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	flags := conf.flagSet("config")
+	names := sortedKeys(sources)
+	sort.SliceStable(names, func(i, j int) bool {
+		return configSection(names[i]) < configSection(names[j])
+	})
+	section := ""
+	for _, name := range names {
+		if s := configSection(name); s != section {
+			section = s
+			fmt.Printf("\n[%s]\n", section)
+		}
+		f := flags.Lookup(name)
+		value := f.Value.String()
+		switch f.Value.(flag.Getter).Get().(type) {
+		case int, bool:
+		default:
+			value = strconv.Quote(value)
+		}
+		if name == "admin-token" && value != `""` {
+			value = `"<hidden>"`
+		}
+		key := strings.Replace(strings.TrimPrefix(name, section+"-"), "-", "_", -1)
+		fmt.Printf("%s = %s # %s\n", key, value, sources[name])
+	}
+	return 0
+}
+
+func configSection(name string) string {
+	for _, s := range configSections {
+		if strings.HasPrefix(name, s+"-") {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		entries []tomlEntry
+		err     string
+	}{
+		{"empty", "", []tomlEntry{}, ""},
+		{
+			"sections",
+			"# settings\nlisten = \":8080\" # HTTP\n\n[limits]\nmemory = '512m'\n  timeout = \"30s\"\n[ log ]\nlevel = \"debug\"\n",
+			[]tomlEntry{{"listen", ":8080", 2}, {"limits.memory", "512m", 5}, {"limits.timeout", "30s", 6}, {"log.level", "debug", 8}},
+			"",
+		},
+		{"section comment", "[egress] # proxy\nrecord = true\n", []tomlEntry{{"egress.record", "true", 2}}, ""},
+		{"escapes", `workdir = "/tmp/a \"b\" #c\t"`, []tomlEntry{{"workdir", "/tmp/a \"b\" #c\t", 1}}, ""},
+		{"literal", `workdir = 'C:\dtc #1' # c`, []tomlEntry{{"workdir", `C:\dtc #1`, 1}}, ""},
+		{"empty string", `admin.token = ""`, []tomlEntry{{"admin.token", "", 1}}, ""},
+		{"integer", "[limits]\npids = 64 # processes\n", []tomlEntry{{"limits.pids", "64", 2}}, ""},
+		{"negative", "n = -1", []tomlEntry{{"n", "-1", 1}}, ""},
+		{"boolean", "record = false", []tomlEntry{{"record", "false", 1}}, ""},
+		{"windows lines", "listen = \":1\"\r\n[log]\r\nlevel = 'warn'\r\n", []tomlEntry{{"listen", ":1", 1}, {"log.level", "warn", 3}}, ""},
+		{"unclosed section", "listen = \":1\"\n[limits\n", nil, "2: invalid section header"},
+		{"text after section", "[limits] memory = '1g'\n", nil, "1: invalid section header"},
+		{"no value", "\n\nlisten\n", nil, "3: expected key = value"},
+		{"no key", "= \":1\"", nil, "1: expected key = value"},
+		{"empty value", "listen =", nil, "1: expected key = value"},
+		{"unclosed string", `listen = ":1`, nil, "1: invalid string"},
+		{"text after string", `listen = ":1" :2`, nil, "1: invalid string"},
+		{"unclosed literal", "listen = ':1", nil, "1: invalid string"},
+		{"text after literal", "listen = ':1' :2", nil, "1: invalid string"},
+		{"bare word", "[log]\nlevel = debug\n", nil, "2: 'debug' is not a string, an integer or a boolean"},
+		{"float", "cpus = 1.5", nil, "1: '1.5' is not a string, an integer or a boolean"},
+	}
+	for _, test := range tests {
+		entries, err := parseTOML(test.data)
+		if got := errString(err); got != test.err {
+			t.Errorf("%s: parseTOML() error = %q, want %q", test.name, got, test.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("%s: parseTOML() = %v, want %v", test.name, entries, test.entries)
+		}
+	}
+}
+
+// testConfig runs loadConfig with the config file data, the variables env
+// and the flags args, from the default config, and returns the config it
+// loaded.
+func testConfig(t *testing.T, data string, env map[string]string, args ...string) (config, map[string]string, error) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "DTC_") {
+			name := kv[:strings.Index(kv, "=")]
+			t.Setenv(name, "")
+			os.Unsetenv(name)
+		}
+	}
+	file := filepath.Join(t.TempDir(), "dtc.toml")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DTC_CONFIG", file)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	saved := conf
+	defer func() { conf = saved }()
+	sources, err := loadConfig("serve", args)
+	return conf, sources, err
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	data := "listen = \":1\"\ndocker = \"podman\"\nshutdown_timeout = \"5s\"\n[limits]\nmemory = \"256m\"\n[log]\nlevel = \"warn\"\n"
+	env := map[string]string{"DTC_LISTEN": ":2", "DTC_LOG_LEVEL": "error", "DTC_WORKDIR": "/w", "DTC_EGRESS_RECORD": "true"}
+	c, sources, err := testConfig(t, data, env, "-listen", ":3", "-limits-memory", "128m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := os.Getenv("DTC_CONFIG")
+	tests := []struct {
+		name, value, source string
+	}{
+		{"listen", c.Listen, "flag"},
+		{"limits-memory", c.Limits.Memory, "flag"},
+		{"log-level", c.LogLevel, "$DTC_LOG_LEVEL"},
+		{"workdir", c.Workdir, "$DTC_WORKDIR"},
+		{"egress-record", map[bool]string{true: "true", false: "false"}[c.EgressRecord], "$DTC_EGRESS_RECORD"},
+		{"docker", c.Docker, file},
+		{"shutdown-timeout", c.ShutdownTimeout.String(), file},
+		{"reaper-age", c.ReaperAge.String(), "default"},
+	}
+	want := map[string]string{
+		"listen": ":3", "limits-memory": "128m", "log-level": "error", "workdir": "/w", "egress-record": "true",
+		"docker": "podman", "shutdown-timeout": "5s", "reaper-age": "1h0m0s",
+	}
+	for _, test := range tests {
+		if test.value != want[test.name] || sources[test.name] != test.source {
+			t.Errorf("%s = %q from %q, want %q from %q", test.name, test.value, sources[test.name], want[test.name], test.source)
+		}
+	}
+	if _, ok := sources["config"]; ok {
+		t.Errorf("config has a source")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{"unknown setting", "listen = \":1\"\n[limits]\nspeed = 3\n", nil, nil, ":3: unknown setting 'limits.speed'"},
+		{"invalid value", "\nshutdown_timeout = \"soon\"\n", nil, nil, ":2: shutdown_timeout: parse error"},
+		{"invalid file", "[limits\n", nil, nil, ":1: invalid section header"},
+		{"invalid variable", "", map[string]string{"DTC_SHUTDOWN_TIMEOUT": "soon"}, nil, "$DTC_SHUTDOWN_TIMEOUT: parse error"},
+		{"invalid setting", "[log]\nlevel = \"loud\"\n", nil, nil, "log-level: 'loud' is not one of debug, info, warn or error"},
+		{"invalid flag over a valid file", "[log]\nlevel = \"warn\"\n", nil, []string{"-log-level", "loud"}, "log-level: 'loud' is not one of debug, info, warn or error"},
+		{"flag over an invalid variable", "", map[string]string{"DTC_LOG_LEVEL": "loud"}, []string{"-log-level", "warn"}, ""},
+		{"argument", "", nil, []string{"serve"}, "unexpected argument 'serve'"},
+	}
+	for _, test := range tests {
+		_, _, err := testConfig(t, test.data, test.env, test.args...)
+		if got := errString(err); (test.err == "") != (got == "") || !strings.Contains(got, test.err) {
+			t.Errorf("%s: loadConfig() error = %q, want it to contain %q", test.name, got, test.err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"time"
+)
+
+// defaultDaemonImage is the image of the Docker daemons given to runs.
+const defaultDaemonImage = "docker:dind"
+
+// daemonStartTimeout is how long a Docker daemon is given to be ready.
+const daemonStartTimeout = 30 * time.Second
+
+// daemon asks for every run of an env to get a Docker daemon of its own, so
+// that what it builds and runs is neither seen by nor overwrites that of the
+// host and of the other runs. The daemon runs in a privileged container next
+// to the run, on a network of their own, with the limits of the env, and
+// stores everything in a volume of the run, of Size where the Docker daemon
+// of the host supports volume quotas. Runs reach it with $DOCKER_HOST.
+//
+// With Build, the code is a Dockerfile that the server builds in the daemon
+// before the run, reporting the progress of every step and then the layers
+// of the image, whose name the run gets in $DTC_IMAGE.
+//
+// With Compose, the code is a Compose file, along with the files of its
+// services, that the run brings up in the daemon, its output tagged with the
+// service logging it.
+type daemon struct {
+	Image   string `json:"image,omitempty"`
+	Size    string `json:"size,omitempty"`
+	Build   bool   `json:"build,omitempty"`
+	Compose bool   `json:"compose,omitempty"`
+}
+
+func (d daemon) validate() map[string]string {
+	problems := map[string]string{}
+	if d.Size != "" && !memoryPattern.MatchString(d.Size) {
+		problems["size"] = fmt.Sprintf("'%s' is not a valid size, e.g. 2g", d.Size)
+	}
+	if d.Build && d.Compose {
+		problems["compose"] = "cannot be used along with build"
+	}
+	return problems
+}
+
+func daemonName(r *run) string {
+	return "dtc-run-" + r.ID + "-docker"
+}
+
+// startDaemon starts the Docker daemon of r on network, with the limits lim,
+// the directory of the run mounted read-only at /dtc and the docker run flags
+// extra, and returns the flags connecting the run to it and a function
+// tearing it down.
+func startDaemon(d daemon, lim limits, r *run, dir, network string, extra []string) ([]string, func(), error) {
+	image := d.Image
+	if image == "" {
+		image = defaultDaemonImage
+	}
+	name := daemonName(r)
+	volume, err := daemonVolume(d, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := func() {
+		if err := docker("container", "rm", "-f", "-v", name); err != nil {
+			slog.Error("cannot remove the Docker daemon", "run", r.ID, "err", err)
+		}
+		if err := docker("volume", "rm", "-f", volume); err != nil {
+			slog.Error("cannot remove the volume of the Docker daemon", "run", r.ID, "volume", volume, "err", err)
+		}
+	}
+	args := []string{"run", "-d", "--privileged", "--name", name,
+		"--network", network, "--network-alias", "docker",
+		"-v", volume + ":/var/lib/docker", "-v", dir + ":/dtc:ro", "-e", "DOCKER_TLS_CERTDIR="}
+	args = append(args, limitArgs(lim)...)
+	args = append(args, extra...)
+	args = append(args, labelArgs(r.ID, r.Created)...)
+	if err := docker(append(args, image)...); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	deadline := time.Now().Add(daemonStartTimeout)
+	for exec.Command(conf.Docker, "exec", name, "docker", "-H", "tcp://127.0.0.1:2375", "info").Run() != nil {
+		if time.Now().After(deadline) {
+			stop()
+			return nil, nil, fmt.Errorf("the Docker daemon of the run did not start in %s", daemonStartTimeout)
+		}
+		select {
+		case <-r.cancelled:
+			stop()
+			return nil, nil, fmt.Errorf("the run was cancelled")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return []string{"-e", "DOCKER_HOST=tcp://docker:2375"}, stop, nil
+}
+
+// daemonVolume creates the volume the Docker daemon of r stores everything
+// in, of d.Size if any. Volume quotas need the local volume driver on XFS
+// with project quotas: the volume is not limited where it does not.
+func daemonVolume(d daemon, r *run) (string, error) {
+	name := daemonName(r)
+	create := append([]string{"volume", "create", "--driver", "local"}, labelArgs(r.ID, r.Created)...)
+	if d.Size != "" {
+		err := docker(append(create, "--opt", "size="+d.Size, name)...)
+		if err == nil {
+			return name, nil
+		}
+		slog.Warn("cannot limit the size of the volume of the Docker daemon", "run", r.ID, "size", d.Size, "err", err)
+	}
+	return name, docker(append(create, name)...)
+}
+
+// createNetwork creates the network of r, internal if it must not reach
+// anything else, and returns a function removing it.
+func createNetwork(r *run, internal bool) (string, func(), error) {
+	network := "dtc-run-" + r.ID
+	args := append([]string{"network", "create"}, labelArgs(r.ID, r.Created)...)
+	if internal {
+		args = append(args, "--internal")
+	}
+	if err := docker(append(args, network)...); err != nil {
+		return "", nil, err
+	}
+	return network, func() {
+		if err := docker("network", "rm", network); err != nil {
+			slog.Error("cannot remove the network", "run", r.ID, "err", err)
+		}
+	}, nil
+}
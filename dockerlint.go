@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Severities of the diagnostics, named like the annotations of the editor.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+)
+
+// diagnostic is a problem found in the code, on lines Line to EndLine which
+// start at 1. Explanation tells students why it matters, and Lesson is the
+// name of the sample of the env showing how to do it right, which the editor
+// opens at Link.
+type diagnostic struct {
+	Line        int    `json:"line"`
+	EndLine     int    `json:"endLine"`
+	Severity    string `json:"severity"`
+	Rule        string `json:"rule"`
+	Message     string `json:"message"`
+	Explanation string `json:"explanation"`
+	Lesson      string `json:"lesson,omitempty"`
+	Link        string `json:"link,omitempty"`
+	// sample is the ID of the sample of the lesson.
+	sample string
+}
+
+// linters check the code of the envs naming one as their lint.
+var linters = map[string]func(code string) []diagnostic{
+	"dockerfile": lintDockerfile,
+}
+
+// lintCode returns the diagnostics of code in env, none if it has no linter,
+// with the lessons of env they point to.
+func lintCode(env env, code string) []diagnostic {
+	lint := linters[env.Lint]
+	if lint == nil {
+		return []diagnostic{}
+	}
+	diags := lint(code)
+	for i, d := range diags {
+		if s, err := env.findSample(d.sample); err == nil {
+			diags[i].Lesson = s.Name
+			diags[i].Link = "#" + env.ID + "/" + s.ID
+		}
+	}
+	return diags
+}
+
+// lintRule is a rule of a linter, and Sample the ID of the sample teaching
+// it in the envs using the linter.
+type lintRule struct {
+	Severity    string
+	Explanation string
+	Sample      string
+}
+
+// dockerfileRules are the rules of the Dockerfile linter, by name.
+var dockerfileRules = map[string]lintRule{
+	"unknown-instruction": {severityError,
+		"Every line of a Dockerfile starts with an instruction like FROM, RUN or COPY, or is a comment starting with #.",
+		"basics"},
+	"from-first": {severityError,
+		"A Dockerfile starts from an image: FROM must be its first instruction, only ARG may come before it.",
+		"basics"},
+	"from-unpinned": {severityWarning,
+		"Without a version, or with latest, the base image changes whenever a new one is published, and the same Dockerfile builds something else tomorrow. Pin a tag like alpine:3.20, or a digest.",
+		"pinned_base_image"},
+	"apt-get-yes": {severityError,
+		"apt-get install asks for a confirmation nobody can give during a build, so the build fails. Add -y to answer yes.",
+		"apt_get"},
+	"apt-get-update-alone": {severityWarning,
+		"The layer of a RUN apt-get update alone is cached, so a later apt-get install keeps using the stale package lists. Run both in the same RUN.",
+		"apt_get"},
+	"apt-get-cleanup": {severityWarning,
+		"The package lists downloaded by apt-get update stay in the layer and make the image bigger. Remove them in the same RUN with rm -rf /var/lib/apt/lists/*.",
+		"apt_get"},
+	"add-instead-of-copy": {severityInfo,
+		"ADD also downloads URLs and extracts archives, which can surprise. To copy files from the build context, COPY does only that.",
+		"copy_or_add"},
+	"many-runs": {severityInfo,
+		"Every RUN makes a layer of the image. Chaining commands with && in a single RUN makes fewer, smaller layers.",
+		"layers"},
+}
+
+var dockerfileInstructions = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true,
+	"ENV": true, "EXPOSE": true, "FROM": true, "HEALTHCHECK": true, "LABEL": true,
+	"MAINTAINER": true, "ONBUILD": true, "RUN": true, "SHELL": true,
+	"STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// instruction is one instruction of a Dockerfile, its continuation lines
+// joined, followed by the lines of its heredocs, if any.
+type instruction struct {
+	Line    int
+	EndLine int
+	Cmd     string
+	Args    string
+}
+
+// heredoc is a heredoc of an instruction, up to the line Name. With Strip,
+// the leading tabs of its lines are removed, as with <<-.
+type heredoc struct {
+	Name  string
+	Strip bool
+}
+
+// heredocPattern matches the start of the heredocs of RUN, COPY and ADD,
+// like <<EOF, <<-EOF or <<"EOF".
+var heredocPattern = regexp.MustCompile(`<<(-?)(["']?)([A-Za-z_][A-Za-z0-9_]*)(["']?)`)
+
+// heredocs returns the heredocs started by in, in order.
+func (in instruction) heredocs() []heredoc {
+	if in.Cmd != "RUN" && in.Cmd != "COPY" && in.Cmd != "ADD" {
+		return nil
+	}
+	docs := []heredoc{}
+	for _, m := range heredocPattern.FindAllStringSubmatchIndex(in.Args, -1) {
+		// <<< is a here-string, not a heredoc.
+		if m[0] > 0 && in.Args[m[0]-1] == '<' {
+			continue
+		}
+		if in.Args[m[4]:m[5]] != in.Args[m[8]:m[9]] {
+			continue
+		}
+		docs = append(docs, heredoc{Name: in.Args[m[6]:m[7]], Strip: m[3] > m[2]})
+	}
+	return docs
+}
+
+// parseDockerfile splits a Dockerfile into instructions, skipping comments
+// and blank lines, even between continuation lines. The lines of heredocs
+// are added to the arguments of their instruction, one per line but for
+// comments and continuation lines.
+func parseDockerfile(src string) []instruction {
+	list := []instruction{}
+	var cur *instruction
+	// docs are the heredocs of cur still to be read.
+	docs := []heredoc{}
+	for i, line := range strings.Split(src, "\n") {
+		if len(docs) > 0 {
+			cur.EndLine = i + 1
+			line = strings.TrimSuffix(line, "\r")
+			if docs[0].Strip {
+				line = strings.TrimLeft(line, "\t")
+			}
+			switch {
+			case line == docs[0].Name:
+				docs = docs[1:]
+				if len(docs) == 0 {
+					list = append(list, *cur)
+					cur = nil
+				}
+			case strings.HasPrefix(strings.TrimSpace(line), "#"):
+			case strings.HasSuffix(cur.Args, "\\"):
+				cur.Args = strings.TrimSuffix(cur.Args, "\\") + " " + strings.TrimSpace(line)
+			default:
+				cur.Args += "\n" + line
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		continued := strings.HasSuffix(trimmed, "\\")
+		trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, "\\"))
+		if cur == nil {
+			cmd := trimmed
+			if end := strings.IndexAny(trimmed, " \t"); end >= 0 {
+				cmd = trimmed[:end]
+			}
+			cur = &instruction{Line: i + 1, Cmd: strings.ToUpper(cmd), Args: strings.TrimSpace(trimmed[len(cmd):])}
+		} else {
+			cur.Args += " " + trimmed
+		}
+		cur.EndLine = i + 1
+		if !continued {
+			if docs = cur.heredocs(); len(docs) == 0 {
+				list = append(list, *cur)
+				cur = nil
+			}
+		}
+	}
+	if cur != nil {
+		list = append(list, *cur)
+	}
+	return list
+}
+
+var (
+	// Flags like --platform=linux/amd64 or --chown=app.
+	flagPattern       = regexp.MustCompile(`^--\S+$`)
+	aptInstallPattern = regexp.MustCompile(`\bapt-get\s+(?:[^\s&|;]+\s+)*?install\b`)
+	aptUpdatePattern  = regexp.MustCompile(`\bapt-get\s+(?:[^\s&|;]+\s+)*?update\b`)
+	aptYesPattern     = regexp.MustCompile(`(?:^|\s)(?:-\w*y\w*|--yes|--assume-yes)\b`)
+	archivePattern    = regexp.MustCompile(`\.(?:tar|tar\.\w+|tgz|tbz2?|txz)$`)
+)
+
+// lintDockerfile returns the diagnostics of the Dockerfile src, by line.
+func lintDockerfile(src string) []diagnostic {
+	diags := []diagnostic{}
+	report := func(in instruction, rule, format string, args ...interface{}) {
+		r := dockerfileRules[rule]
+		diags = append(diags, diagnostic{Line: in.Line, EndLine: in.EndLine, Severity: r.Severity, Rule: rule,
+			Message: fmt.Sprintf(format, args...), Explanation: r.Explanation, sample: r.Sample})
+	}
+	list := parseDockerfile(src)
+	stages := map[string]bool{}
+	seenFrom := false
+	// chain are the RUN instructions in a row so far.
+	chain := []instruction{}
+	endChain := func() {
+		if len(chain) > 2 {
+			last := chain[len(chain)-1]
+			report(instruction{Line: chain[0].Line, EndLine: last.EndLine}, "many-runs",
+				"%d RUN instructions in a row make %d layers", len(chain), len(chain))
+		}
+		chain = chain[:0]
+	}
+	for _, in := range list {
+		if in.Cmd != "RUN" {
+			endChain()
+		}
+		if !dockerfileInstructions[in.Cmd] {
+			report(in, "unknown-instruction", "unknown instruction %s", in.Cmd)
+			continue
+		}
+		if !seenFrom && in.Cmd != "FROM" && in.Cmd != "ARG" {
+			report(in, "from-first", "%s comes before FROM", in.Cmd)
+			seenFrom = true
+		}
+		switch in.Cmd {
+		case "FROM":
+			seenFrom = true
+			args := []string{}
+			for _, a := range strings.Fields(in.Args) {
+				if !flagPattern.MatchString(a) {
+					args = append(args, a)
+				}
+			}
+			if len(args) == 0 {
+				continue
+			}
+			image := args[0]
+			if len(args) == 3 && strings.EqualFold(args[1], "AS") {
+				stages[strings.ToLower(args[2])] = true
+			}
+			if image == "scratch" || stages[strings.ToLower(image)] || strings.Contains(image, "$") || strings.Contains(image, "@") {
+				continue
+			}
+			name := image[strings.LastIndex(image, "/")+1:]
+			if i := strings.Index(name, ":"); i < 0 {
+				report(in, "from-unpinned", "%s is not pinned to a version", image)
+			} else if name[i+1:] == "latest" {
+				report(in, "from-unpinned", "%s is not pinned to a version, latest changes", image)
+			}
+		case "RUN":
+			chain = append(chain, in)
+			lintAptGet(in, report)
+		case "ADD":
+			args := []string{}
+			for _, a := range strings.Fields(in.Args) {
+				if !flagPattern.MatchString(a) {
+					args = append(args, a)
+				}
+			}
+			if len(args) < 2 || strings.HasPrefix(args[0], "[") {
+				continue
+			}
+			local := true
+			for _, src := range args[:len(args)-1] {
+				if strings.Contains(src, "://") || strings.HasPrefix(src, "git@") || archivePattern.MatchString(src) {
+					local = false
+				}
+			}
+			if local {
+				report(in, "add-instead-of-copy", "ADD copies local files, use COPY")
+			}
+		}
+	}
+	endChain()
+	return diags
+}
+
+// lintAptGet checks the apt-get commands of a RUN instruction.
+func lintAptGet(in instruction, report func(instruction, string, string, ...interface{})) {
+	install := aptInstallPattern.FindAllStringIndex(in.Args, -1)
+	update := aptUpdatePattern.MatchString(in.Args)
+	for _, loc := range install {
+		// The options of apt-get install go up to the end of its command, or
+		// of its line in a heredoc.
+		rest := in.Args[loc[0]:]
+		if end := strings.IndexAny(rest, "&|;\n"); end >= 0 {
+			rest = rest[:end]
+		}
+		if !aptYesPattern.MatchString(rest) {
+			report(in, "apt-get-yes", "apt-get install without -y")
+			break
+		}
+	}
+	switch {
+	case update && len(install) == 0:
+		report(in, "apt-get-update-alone", "apt-get update without apt-get install in the same RUN")
+	case update && !strings.Contains(in.Args, "/var/lib/apt/lists"):
+		report(in, "apt-get-cleanup", "the package lists of apt-get update are left in the image")
+	}
+}
+
+// lintMessage describes the diagnostics of file as text, for the output of
+// the run.
+func lintMessage(file string, diags []diagnostic) string {
+	lines := []string{}
+	for _, d := range diags {
+		lines = append(lines, fmt.Sprintf("%s:%d: %s: %s (%s)", file, d.Line, d.Severity, d.Message, d.Rule),
+			"    "+d.Explanation)
+		if d.Lesson != "" {
+			lines = append(lines, fmt.Sprintf("    See the sample \"%s\"", d.Lesson))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseDockerfileHeredocs(t *testing.T) {
+	src := `FROM debian:12
+RUN <<EOF
+apt-get update
+# not an instruction
+apt-get install \
+    -y curl
+EOF
+COPY <<-A <<"B" /etc/
+	a
+	A
+b
+B
+RUN cat <<<"not a heredoc"
+CMD ["true"]
+`
+	want := []instruction{
+		{Line: 1, EndLine: 1, Cmd: "FROM", Args: "debian:12"},
+		{Line: 2, EndLine: 7, Cmd: "RUN", Args: "<<EOF\napt-get update\napt-get install  -y curl"},
+		{Line: 8, EndLine: 12, Cmd: "COPY", Args: "<<-A <<\"B\" /etc/\na\nb"},
+		{Line: 13, EndLine: 13, Cmd: "RUN", Args: `cat <<<"not a heredoc"`},
+		{Line: 14, EndLine: 14, Cmd: "CMD", Args: `["true"]`},
+	}
+	if got := parseDockerfile(src); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDockerfile() =\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestLintDockerfileHeredocs(t *testing.T) {
+	diags := lintDockerfile("FROM debian:12\nRUN <<EOF\napt-get update\napt-get install curl\nEOF\n")
+	rules := []string{}
+	for _, d := range diags {
+		rules = append(rules, d.Rule)
+	}
+	if want := []string{"apt-get-yes", "apt-get-cleanup"}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+}
+
+func TestLintDockerfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		rules []string
+	}{
+		{"clean", "FROM alpine:3.20\nRUN echo hi\nCMD [\"true\"]\n", nil},
+		{"lowercase", "from alpine:3.20\nrun echo hi\n", nil},
+		{"unknown instruction", "FROM alpine:3.20\nFOO bar\n", []string{"2-2 unknown-instruction"}},
+		{"from first", "RUN echo hi\nFROM alpine:3.20\n", []string{"1-1 from-first"}},
+		{"from first once", "LABEL a=b\nRUN echo hi\nFROM alpine:3.20\n", []string{"1-1 from-first"}},
+		{"arg before from", "ARG VERSION=3.20\nFROM alpine:$VERSION\n", nil},
+		{"unpinned", "FROM alpine\n", []string{"1-1 from-unpinned"}},
+		{"latest", "FROM alpine:latest\n", []string{"1-1 from-unpinned"}},
+		{"registry port", "FROM localhost:5000/alpine\n", []string{"1-1 from-unpinned"}},
+		{"registry port pinned", "FROM localhost:5000/alpine:3.20\n", nil},
+		{"digest", "FROM alpine@sha256:1e42bbe2508154c9126d48c2b8a75420c3544343bf86fd041fb7527e017a4b4a\n", nil},
+		{"scratch", "FROM scratch\n", nil},
+		{"variable", "ARG BASE\nFROM $BASE\n", nil},
+		{"stage", "FROM golang:1.21 AS build\nFROM build\n", nil},
+		{"stage case", "FROM golang:1.21 as Build\nFROM build\n", nil},
+		{"unpinned after stage", "FROM golang:1.21 AS build\nFROM alpine\n", []string{"2-2 from-unpinned"}},
+		{"platform", "FROM --platform=linux/amd64 alpine\n", []string{"1-1 from-unpinned"}},
+		{"platform variable", "FROM --platform=$BUILDPLATFORM alpine:3.20\n", nil},
+		{"add local", "FROM alpine:3.20\nADD app.py /app/\n", []string{"2-2 add-instead-of-copy"}},
+		{"add local flag", "FROM alpine:3.20\nADD --chown=app app.py /app/\n", []string{"2-2 add-instead-of-copy"}},
+		{"add url", "FROM alpine:3.20\nADD https://example.com/app.py /app/\n", nil},
+		{"add git", "FROM alpine:3.20\nADD git@github.com:docker/cli.git /cli\n", nil},
+		{"add archive", "FROM alpine:3.20\nADD app.tar.gz /app/\n", nil},
+		{"add archive among files", "FROM alpine:3.20\nADD app.py app.tgz /app/\n", nil},
+		{"add json form", "FROM alpine:3.20\nADD [\"app.py\", \"/app/\"]\n", nil},
+		{"copy", "FROM alpine:3.20\nCOPY app.py /app/\n", nil},
+		{"apt-get without -y", "FROM debian:12\nRUN apt-get install curl\n", []string{"2-2 apt-get-yes"}},
+		{"apt-get -y", "FROM debian:12\nRUN apt-get install -y curl\n", nil},
+		{"apt-get -y first", "FROM debian:12\nRUN apt-get -y install curl\n", nil},
+		{"apt-get -qy", "FROM debian:12\nRUN apt-get install -qy curl\n", nil},
+		{"apt-get --yes", "FROM debian:12\nRUN apt-get install --yes curl\n", nil},
+		{"apt-get -y of another command", "FROM debian:12\nRUN apt-get install curl && echo -y\n", []string{"2-2 apt-get-yes"}},
+		{"apt-get update alone", "FROM debian:12\nRUN apt-get update\nRUN apt-get install -y curl\n", []string{"2-2 apt-get-update-alone"}},
+		{"apt-get no cleanup", "FROM debian:12\nRUN apt-get update && apt-get install -y curl\n", []string{"2-2 apt-get-cleanup"}},
+		{"apt-get cleanup", "FROM debian:12\nRUN apt-get update \\\n && apt-get install -y curl \\\n && rm -rf /var/lib/apt/lists/*\n", nil},
+		{"two runs", "FROM alpine:3.20\nRUN a\nRUN b\n", nil},
+		{"many runs", "FROM alpine:3.20\nRUN a\nRUN b \\\n  c\nRUN d\nCOPY x /x\nRUN e\nRUN f\n", []string{"2-5 many-runs"}},
+		{"many runs at the end", "FROM alpine:3.20\nCOPY x /x\nRUN a\n# b\nRUN b\n\nRUN c\nRUN d\n", []string{"3-8 many-runs"}},
+	}
+	for _, test := range tests {
+		rules := []string{}
+		for _, d := range lintDockerfile(test.src) {
+			rules = append(rules, fmt.Sprintf("%d-%d %s", d.Line, d.EndLine, d.Rule))
+			if r := dockerfileRules[d.Rule]; d.Severity != r.Severity || d.Explanation != r.Explanation {
+				t.Errorf("%s: the diagnostic of %s does not have the severity and explanation of its rule", test.name, d.Rule)
+			}
+		}
+		if len(test.rules) == 0 {
+			test.rules = []string{}
+		}
+		if !reflect.DeepEqual(rules, test.rules) {
+			t.Errorf("%s: rules = %q, want %q", test.name, rules, test.rules)
+		}
+	}
+}
+
+func TestLintCodeLessons(t *testing.T) {
+	l := env{ID: "dockerfile", Lint: "dockerfile", Samples: []sample{{ID: "pinned_base_image", Name: "Pinning the base image"}}}
+	diags := lintCode(l, "FROM alpine\nADD app.py /app/\n")
+	lessons := []string{}
+	for _, d := range diags {
+		lessons = append(lessons, d.Rule+" "+d.Lesson+" "+d.Link)
+	}
+	want := []string{"from-unpinned Pinning the base image #dockerfile/pinned_base_image", "add-instead-of-copy  "}
+	if !reflect.DeepEqual(lessons, want) {
+		t.Errorf("lessons = %q, want %q", lessons, want)
+	}
+	if diags := lintCode(env{ID: "python"}, "FROM alpine\n"); len(diags) != 0 {
+		t.Errorf("lintCode() of an env with no lint = %v, want none", diags)
+	}
+	for rule, r := range dockerfileRules {
+		if r.Sample == "" {
+			t.Errorf("the rule %s has no lesson", rule)
+		}
+	}
+}
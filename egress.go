@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// egressStartTimeout is how long the egress proxy of a run is given to be
+// ready.
+const egressStartTimeout = 30 * time.Second
+
+// egressMount is where runs find the certificate authority of their proxy,
+// and the Docker config using it.
+const egressMount = "/etc/dtc/egress"
+
+// Network policies of the runs of an env or sample: no network at all, only
+// the hosts of the allowlist, or all of it.
+const (
+	networkNone      = "none"
+	networkAllowlist = "allowlist"
+	networkFull      = "full"
+)
+
+// networkPolicy is what runs may reach of the network. With none or
+// allowlist, runs are on an internal network whose only way out is an egress
+// proxy, that reports the requests it blocks.
+type networkPolicy struct {
+	Policy string   `json:"policy"`
+	Allow  []string `json:"allow,omitempty"`
+}
+
+// allowPattern matches the entries of allowlists: a host name, or *.
+// followed by a domain for all the hosts in it, with an optional port.
+var allowPattern = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9.-]*[a-z0-9])?(:[0-9]{1,5})?$`)
+
+func (n networkPolicy) validate() map[string]string {
+	problems := map[string]string{}
+	switch n.Policy {
+	case networkNone, networkFull:
+		if len(n.Allow) > 0 {
+			problems["allow"] = "is only used by the allowlist policy"
+		}
+	case networkAllowlist:
+		if len(n.Allow) == 0 {
+			problems["allow"] = "must list at least one host"
+		}
+		for i, a := range n.Allow {
+			if !allowPattern.MatchString(a) {
+				problems[fmt.Sprintf("allow[%d]", i)] = fmt.Sprintf("'%s' is not a host name, *.domain, or either with :port", a)
+			}
+		}
+	default:
+		problems["policy"] = fmt.Sprintf("'%s' is not one of none, allowlist or full", n.Policy)
+	}
+	return problems
+}
+
+// egressSidecar is the egress proxy of a run, in a container of its own on
+// the network of the run. The network is internal: the proxy is the only
+// way out, and only in record and allow modes.
+type egressSidecar struct {
+	name  string
+	mode  string
+	allow []string
+	dir   string
+	url   string
+	logs  *exec.Cmd
+	// followed is closed once the logs of the proxy are all read.
+	followed chan struct{}
+	// save is where the fixtures go once recorded, if anywhere.
+	save string
+}
+
+// egressMode returns the mode of the egress proxy of the run of req in env,
+// from its sample s if any, and the hosts it lets through, or no mode if
+// the run needs no proxy. The egress mode and network policy of s override
+// those of env, and only the samples are recorded, only for the code of s
+// as is: changed code would reach what the sample is allowed to otherwise.
+func egressMode(env env, s *sample, req request) (string, []string) {
+	unchanged := s != nil && s.unchanged(env, req)
+	egress := env.Egress
+	if unchanged && s.Egress != "" {
+		egress = s.Egress
+	}
+	if egress == egressReplay && conf.EgressRecord && unchanged {
+		return egressRecord, nil
+	}
+	if egress != "" {
+		return egress, nil
+	}
+	policy := env.Network
+	if unchanged && s.Network != nil {
+		policy = s.Network
+	}
+	if policy == nil {
+		return "", nil
+	}
+	switch policy.Policy {
+	case networkNone:
+		return egressDeny, nil
+	case networkAllowlist:
+		return egressAllow, policy.Allow
+	}
+	return "", nil
+}
+
+// startEgress starts the egress proxy of r on network in mode, letting
+// through the hosts of allow or with the fixtures of s if any, and reports
+// what it does with the requests of the run as events.
+func startEgress(env env, s *sample, mode string, allow []string, r *run, network string) (*egressSidecar, error) {
+	dir, err := ioutil.TempDir(conf.Workdir, "dtc-egress-")
+	if err != nil {
+		return nil, err
+	}
+	e := &egressSidecar{name: "dtc-run-" + r.ID + "-egress", mode: mode, allow: allow, dir: dir}
+	if err := e.prepare(env, s); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	args := []string{"run", "-d", "--name", e.name, "--network", network, "-v", dir + ":/egress"}
+	args = append(args, labelArgs(r.ID, r.Created)...)
+	args = append(args, conf.EgressImage, "dtc", "proxy", "-mode", e.mode, "-dir", "/egress")
+	if len(allow) > 0 {
+		args = append(args, "-allow", strings.Join(allow, ","))
+	}
+	if err := docker(args...); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := e.start(r, network); err != nil {
+		e.stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// prepare writes what the proxy and the run need to the directory of the
+// proxy: the certificate authority, the fixtures to replay, and the Docker
+// config making Docker use the proxy too.
+func (e *egressSidecar) prepare(env env, s *sample) error {
+	if err := newCA(e.dir, 24*time.Hour); err != nil {
+		return err
+	}
+	if s != nil && s.Fixtures != "" {
+		path := filepath.Join(env.path, s.Fixtures)
+		switch e.mode {
+		case egressReplay:
+			data, err := ioutil.ReadFile(path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil {
+				if err := ioutil.WriteFile(filepath.Join(e.dir, fixturesFile), data, 0644); err != nil {
+					return err
+				}
+			}
+		case egressRecord:
+			e.save = path
+		}
+	}
+	return os.MkdirAll(filepath.Join(e.dir, "docker"), 0755)
+}
+
+// start waits for the proxy to be ready, then follows what it does.
+func (e *egressSidecar) start(r *run, network string) error {
+	if e.mode == egressRecord || e.mode == egressAllow {
+		if err := docker("network", "connect", "bridge", e.name); err != nil {
+			return err
+		}
+	}
+	out, err := exec.Command(conf.Docker, "container", "inspect", "--format",
+		fmt.Sprintf("{{ (index .NetworkSettings.Networks %q).IPAddress }}", network), e.name).Output()
+	if err != nil {
+		return fmt.Errorf("cannot find the address of the egress proxy: %v", err)
+	}
+	// Containers run by the Docker daemon of the run cannot resolve the name
+	// of the proxy, so it goes by its address.
+	e.url = "http://" + strings.TrimSpace(string(out)) + ":3128"
+	config := map[string]interface{}{"proxies": map[string]interface{}{"default": map[string]string{
+		"httpProxy": e.url, "httpsProxy": e.url, "noProxy": noProxy}}}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(e.dir, "docker", "config.json"), data, 0644); err != nil {
+		return err
+	}
+	e.logs = exec.Command(conf.Docker, "logs", "-f", e.name)
+	logs, err := e.logs.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := e.logs.Start(); err != nil {
+		return err
+	}
+	ready := make(chan bool, 1)
+	e.followed = make(chan struct{})
+	go func() {
+		defer close(e.followed)
+		scanner := bufio.NewScanner(logs)
+		listening := false
+		for scanner.Scan() {
+			ev := egressEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+				continue
+			}
+			if ev.Action == egressListening {
+				listening = true
+				ready <- true
+				continue
+			}
+			r.emit(event{Type: eventEgress, Message: ev.message(e.allow), Egress: &ev})
+		}
+		if !listening {
+			ready <- false
+		}
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			return fmt.Errorf("the egress proxy of the run did not start")
+		}
+	case <-time.After(egressStartTimeout):
+		return fmt.Errorf("the egress proxy of the run did not start in %s", egressStartTimeout)
+	}
+	return nil
+}
+
+// noProxy are the hosts runs reach without the proxy: themselves and their
+// Docker daemon.
+const noProxy = "localhost,127.0.0.1,docker"
+
+// runArgs returns the docker run flags making a container go through the
+// proxy and trust its certificate authority. In allow mode, the proxy does
+// not see into HTTPS, which keeps the certificates of the hosts.
+func (e *egressSidecar) runArgs() []string {
+	args := []string{"-v", e.dir + "/" + caCertFile + ":" + egressMount + "/" + caCertFile + ":ro",
+		"-v", e.dir + "/docker:" + egressMount + "/docker:ro",
+		"-e", "DOCKER_CONFIG=" + egressMount + "/docker"}
+	for _, k := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		args = append(args, "-e", k+"="+e.url)
+	}
+	args = append(args, "-e", "NO_PROXY="+noProxy, "-e", "no_proxy="+noProxy)
+	if e.mode == egressAllow {
+		return args
+	}
+	for _, k := range []string{"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE", "CURL_CA_BUNDLE", "NODE_EXTRA_CA_CERTS"} {
+		args = append(args, "-e", k+"="+egressMount+"/"+caCertFile)
+	}
+	return args
+}
+
+// stop removes the proxy, after saving what it recorded.
+func (e *egressSidecar) stop() {
+	if e.save != "" {
+		data, err := ioutil.ReadFile(filepath.Join(e.dir, fixturesFile))
+		if err == nil {
+			err = ioutil.WriteFile(e.save, data, 0644)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("cannot save the fixtures", "file", e.save, "err", err)
+		} else if err == nil {
+			slog.Info("saved the fixtures", "file", e.save)
+		}
+	}
+	if err := docker("container", "rm", "-f", e.name); err != nil {
+		slog.Error("cannot remove the egress proxy", "container", e.name, "err", err)
+	}
+	if e.logs != nil {
+		<-e.followed
+		e.logs.Wait()
+	}
+	os.RemoveAll(e.dir)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllowPattern(t *testing.T) {
+	tests := []struct {
+		entry string
+		valid bool
+	}{
+		{"pypi.org", true},
+		{"*.pythonhosted.org", true},
+		{"pypi.org:443", true},
+		{"*.example.com:8080", true},
+		{"localhost", true},
+		{"10.0.0.1", true},
+		{"", false},
+		{"*", false},
+		{"*.", false},
+		{"**.example.com", false},
+		{"a.*.example.com", false},
+		{"example.com.", false},
+		{".example.com", false},
+		{"-example.com", false},
+		{"Example.com", false},
+		{"example.com:", false},
+		{"example.com:123456", false},
+		{"example.com:http", false},
+		{"http://example.com", false},
+		{"example.com/path", false},
+	}
+	for _, test := range tests {
+		if valid := allowPattern.MatchString(test.entry); valid != test.valid {
+			t.Errorf("allowPattern.MatchString(%q) = %t, want %t", test.entry, valid, test.valid)
+		}
+	}
+}
+
+func TestEgressProxyAllowed(t *testing.T) {
+	p := &egressProxy{mode: egressAllow, allow: []string{"pypi.org", "*.pythonhosted.org", "api.test:8443", "*.example.com:443"}}
+	tests := []struct {
+		host, port string
+		allowed    bool
+	}{
+		{"pypi.org", "443", true},
+		{"pypi.org", "80", true},
+		{"PyPI.org", "443", true},
+		{"pypi.org.", "443", true},
+		{"pypi.org..", "443", false},
+		{"www.pypi.org", "443", false},
+		{"evilpypi.org", "443", false},
+		{"pypi.org.evil.com", "443", false},
+		{"files.pythonhosted.org", "443", true},
+		{"a.b.pythonhosted.org", "80", true},
+		{"files.pythonhosted.org.", "443", true},
+		{"pythonhosted.org", "443", false},
+		{"evilpythonhosted.org", "443", false},
+		{"pythonhosted.org.evil.com", "443", false},
+		{"api.test", "8443", true},
+		{"api.test", "443", false},
+		{"api.test", "", false},
+		{"www.example.com", "443", true},
+		{"www.example.com", "80", false},
+		{"example.com", "443", false},
+		{"", "443", false},
+	}
+	for _, test := range tests {
+		if allowed := p.allowed(test.host, test.port); allowed != test.allowed {
+			t.Errorf("allowed(%q, %q) = %t, want %t", test.host, test.port, allowed, test.allowed)
+		}
+	}
+}
+
+func TestEgressModeSampleOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "offline.py"), []byte("print(1)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := sample{ID: "offline", File: "offline.py", Network: &networkPolicy{Policy: networkAllowlist, Allow: []string{"pypi.org"}}}
+	l := env{ID: "python", Network: &networkPolicy{Policy: networkNone}, Samples: []sample{s}, path: dir}
+	tests := []struct {
+		name string
+		req  request
+		mode string
+	}{
+		{"unchanged", request{Sample: "offline", Code: "print(1)\n"}, egressAllow},
+		{"edited", request{Sample: "offline", Code: "print(2)\n"}, egressDeny},
+		{"trailing newline", request{Sample: "offline", Code: "print(1)"}, egressDeny},
+		{"extra file", request{Sample: "offline", Code: "print(1)\n", Files: []requestFile{{Name: "a.py"}}}, egressDeny},
+	}
+	for _, test := range tests {
+		if mode, _ := egressMode(l, &s, test.req); mode != test.mode {
+			t.Errorf("%s: egressMode() = %q, want %q", test.name, mode, test.mode)
+		}
+	}
+}
+
+func TestEgressModeSampleEgress(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "curl.Dockerfile"), []byte("FROM alpine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := sample{ID: "curl", File: "curl.Dockerfile", Egress: egressReplay, Fixtures: "curl.json"}
+	l := env{ID: "dockerfile", Samples: []sample{s}, path: dir}
+	unchanged, edited := request{Sample: "curl", Code: "FROM alpine\n"}, request{Sample: "curl", Code: "FROM debian\n"}
+	defer func(record bool) { conf.EgressRecord = record }(conf.EgressRecord)
+	tests := []struct {
+		name   string
+		record bool
+		req    request
+		mode   string
+	}{
+		{"unchanged", false, unchanged, egressReplay},
+		{"edited", false, edited, ""},
+		{"recording unchanged", true, unchanged, egressRecord},
+		{"recording edited", true, edited, ""},
+	}
+	for _, test := range tests {
+		conf.EgressRecord = test.record
+		if mode, _ := egressMode(l, &s, test.req); mode != test.mode {
+			t.Errorf("%s: egressMode() = %q, want %q", test.name, mode, test.mode)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// entrypoint derives the file name of the submitted code, and the variables
+// its env needs to run it, from the code itself. It is meant for languages
+// such as Java, where the file has to be named after the public class.
+//
+// Pattern is matched against the code and File and Env values are expanded
+// with its submatches, as in regexp.Expand: "${class}.java".
+type entrypoint struct {
+	Pattern string            `json:"pattern"`
+	File    string            `json:"file"`
+	Env     map[string]string `json:"env,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// valuePattern restricts what a detected value can be, as it ends up both in
+// a file name and in the environment of the run.
+var valuePattern = regexp.MustCompile(`^[A-Za-z0-9_.$-]+$`)
+
+func (e entrypoint) validate() map[string]string {
+	problems := map[string]string{}
+	re, err := regexp.Compile(e.Pattern)
+	if e.Pattern == "" {
+		problems["pattern"] = "is required"
+	} else if err != nil {
+		problems["pattern"] = err.Error()
+	}
+	if e.File == "" {
+		problems["file"] = "is required"
+	}
+	if re == nil {
+		return problems
+	}
+	groups := map[string]bool{}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = true
+		}
+	}
+	check := func(field, tmpl string) {
+		for _, ref := range refPattern.FindAllStringSubmatch(tmpl, -1) {
+			name := ref[1] + ref[2]
+			if _, err := strconv.Atoi(name); err == nil {
+				continue
+			}
+			if !groups[name] {
+				problems[field] = fmt.Sprintf("'%s' is not a group of the pattern", name)
+			}
+		}
+	}
+	check("file", e.File)
+	for k, v := range e.Env {
+		check("env."+k, v)
+	}
+	return problems
+}
+
+var refPattern = regexp.MustCompile(`\$(?:\{(\w+)\}|(\w+))`)
+
+// detect returns the file name the code must be written to, and the variables
+// to give to its container.
+func (e entrypoint) detect(code string) (string, map[string]string, error) {
+	re, err := regexp.Compile(e.Pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	match := re.FindStringSubmatchIndex(code)
+	if match == nil {
+		if e.Error != "" {
+			return "", nil, fmt.Errorf("%s", e.Error)
+		}
+		return "", nil, fmt.Errorf("could not find the entrypoint of the code, it must match %s", e.Pattern)
+	}
+	for i := 2; i < len(match); i += 2 {
+		if match[i] < 0 {
+			continue
+		}
+		if value := code[match[i]:match[i+1]]; !valuePattern.MatchString(value) {
+			return "", nil, fmt.Errorf("'%s' cannot be used as an entrypoint name", value)
+		}
+	}
+	expand := func(tmpl string) string {
+		return string(re.ExpandString(nil, tmpl, code, match))
+	}
+	file := expand(e.File)
+	if file == "" || file == "." || file == ".." || filepath.Base(file) != file {
+		return "", nil, fmt.Errorf("'%s' is not a valid file name", file)
+	}
+	vars := map[string]string{}
+	for k, v := range e.Env {
+		vars[k] = expand(v)
+	}
+	return file, vars, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEntrypointDetect(t *testing.T) {
+	java := entrypoint{
+		Pattern: `public\s+(?:final\s+|abstract\s+)*class\s+(?P<class>\w+)`,
+		File:    "${class}.java",
+		Env:     map[string]string{"DTC_CLASS": "${class}"},
+		Error:   "a Java program needs a public class, e.g. public class Main { ... }",
+	}
+	tests := []struct {
+		name string
+		e    entrypoint
+		code string
+		file string
+		vars map[string]string
+		err  string
+	}{
+		{"class", java, "public class Main {\n}\n", "Main.java", map[string]string{"DTC_CLASS": "Main"}, ""},
+		{"final class", java, "import java.util.*;\n\npublic final class Hello_2 {}", "Hello_2.java", map[string]string{"DTC_CLASS": "Hello_2"}, ""},
+		{"first class", java, "public class A {}\npublic class B {}", "A.java", map[string]string{"DTC_CLASS": "A"}, ""},
+		{"no class", java, "class Main {}", "", nil, java.Error},
+		{"default error", entrypoint{Pattern: `module (\w+)`, File: "$1.mod"}, "", "", nil, `could not find the entrypoint of the code, it must match module (\w+)`},
+		{"numbered group", entrypoint{Pattern: `module (\w+)`, File: "$1.mod"}, "module app", "app.mod", map[string]string{}, ""},
+		{"invalid value", entrypoint{Pattern: `name: (\S+)`, File: "${1}.txt"}, "name: ../../etc/passwd", "", nil, "'../../etc/passwd' cannot be used as an entrypoint name"},
+		{"variable value", entrypoint{Pattern: `name: (\S+)`, File: "a.txt", Env: map[string]string{"A": "$1"}}, "name: $(id)", "", nil, "'$(id)' cannot be used as an entrypoint name"},
+		{"dot dot file", entrypoint{Pattern: `name: (\S+)`, File: "$1"}, "name: ..", "", nil, "'..' is not a valid file name"},
+		{"empty file", entrypoint{Pattern: `name(?:: (\w+))?`, File: "$1"}, "name", "", nil, "'' is not a valid file name"},
+		{"directory file", entrypoint{Pattern: `name: (\w+)`, File: "src/$1.txt"}, "name: a", "", nil, "'src/a.txt' is not a valid file name"},
+	}
+	for _, test := range tests {
+		file, vars, err := test.e.detect(test.code)
+		if got := errString(err); got != test.err {
+			t.Errorf("%s: detect() error = %q, want %q", test.name, got, test.err)
+			continue
+		}
+		if file != test.file || !reflect.DeepEqual(vars, test.vars) {
+			t.Errorf("%s: detect() = %q, %v, want %q, %v", test.name, file, vars, test.file, test.vars)
+		}
+	}
+}
+
+func TestEntrypointValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		e        entrypoint
+		problems map[string]string
+	}{
+		{"valid", entrypoint{Pattern: `class (?P<class>\w+)`, File: "${class}.java", Env: map[string]string{"DTC_CLASS": "$class"}}, map[string]string{}},
+		{"numbered", entrypoint{Pattern: `class (\w+)`, File: "$1.java"}, map[string]string{}},
+		{"missing", entrypoint{}, map[string]string{"pattern": "is required", "file": "is required"}},
+		{"invalid pattern", entrypoint{Pattern: `class (`, File: "a.java"}, map[string]string{"pattern": "error parsing regexp: missing closing ): `class (`"}},
+		{"unknown group", entrypoint{Pattern: `class (?P<class>\w+)`, File: "${name}.java", Env: map[string]string{"DTC_CLASS": "${klass}"}},
+			map[string]string{"file": "'name' is not a group of the pattern", "env.DTC_CLASS": "'klass' is not a group of the pattern"}},
+	}
+	for _, test := range tests {
+		if problems := test.e.validate(); !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s: validate() = %v, want %v", test.name, problems, test.problems)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sample struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	File  string `json:"file"`
+	Input string `json:"input"`
+	// Egress overrides the egress mode of the env for the runs of the sample
+	// whose code is unchanged.
+	Egress string `json:"egress,omitempty"`
+	// Fixtures are the answers recorded by the egress proxy for the runs of
+	// the sample.
+	Fixtures string `json:"fixtures,omitempty"`
+	// Network overrides the network policy of the env for the runs of the
+	// sample whose code is unchanged.
+	Network *networkPolicy `json:"network,omitempty"`
+	// Dependencies is the dependency file of the sample, which the runs of
+	// the sample get unless the code comes with one.
+	Dependencies string `json:"dependencies,omitempty"`
+}
+
+// version is one toolchain of an env. Every version gets its own image, built
+// from the env Dockerfile with Args as build arguments.
+type version struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Default bool              `json:"default,omitempty"`
+	Args    map[string]string `json:"args,omitempty"`
+	// Packages set to false keeps the runs of the version away from the
+	// package cache of the env, for toolchains its manager does not support.
+	Packages *bool `json:"packages,omitempty"`
+}
+
+// limits bound the resources of a run. Memory, CPUs and PIDs are given to
+// docker run as is; Timeout is a Go duration after which the run is killed.
+type limits struct {
+	Memory  string `json:"memory,omitempty"`
+	CPUs    string `json:"cpus,omitempty"`
+	PIDs    int    `json:"pids,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+	// Output is how much a run can write to stdout and stderr before it is
+	// killed.
+	Output string `json:"output,omitempty"`
+}
+
+func (lim limits) timeout() time.Duration {
+	d, _ := time.ParseDuration(lim.Timeout)
+	return d
+}
+
+// or fills the limits lim leaves unset with those of def.
+func (lim limits) or(def limits) limits {
+	if lim.Memory == "" {
+		lim.Memory = def.Memory
+	}
+	if lim.CPUs == "" {
+		lim.CPUs = def.CPUs
+	}
+	if lim.PIDs == 0 {
+		lim.PIDs = def.PIDs
+	}
+	if lim.Timeout == "" {
+		lim.Timeout = def.Timeout
+	}
+	if lim.Output == "" {
+		lim.Output = def.Output
+	}
+	return lim
+}
+
+// validate returns the problems with lim by field name.
+func (lim limits) validate() map[string]string {
+	problems := map[string]string{}
+	if lim.Memory != "" && !memoryPattern.MatchString(lim.Memory) {
+		problems["memory"] = fmt.Sprintf("'%s' is not a valid size, e.g. 256m", lim.Memory)
+	}
+	if lim.CPUs != "" {
+		if n, err := strconv.ParseFloat(lim.CPUs, 64); err != nil || n <= 0 {
+			problems["cpus"] = fmt.Sprintf("'%s' is not a valid number of CPUs", lim.CPUs)
+		}
+	}
+	if lim.PIDs < 0 {
+		problems["pids"] = "must not be negative"
+	}
+	if lim.Timeout != "" {
+		if d, err := time.ParseDuration(lim.Timeout); err != nil || d <= 0 {
+			problems["timeout"] = fmt.Sprintf("'%s' is not a valid duration, e.g. 30s", lim.Timeout)
+		}
+	}
+	if lim.Output != "" && !memoryPattern.MatchString(lim.Output) {
+		problems["output"] = fmt.Sprintf("'%s' is not a valid size, e.g. 1m", lim.Output)
+	}
+	return problems
+}
+
+// compat maps the language identifiers of other code execution APIs to an
+// env: Piston language names and aliases, and Judge0 language IDs, each to
+// the ID of the version it runs, the default one if empty.
+type compat struct {
+	Piston []string       `json:"piston,omitempty"`
+	Judge0 map[int]string `json:"judge0,omitempty"`
+}
+
+type env struct {
+	ID         string            `json:"id,omitempty"`
+	Extends    string            `json:"extends,omitempty"`
+	Name       string            `json:"name"`
+	Mode       string            `json:"mode"`
+	File       string            `json:"file"`
+	Entrypoint *entrypoint       `json:"entrypoint,omitempty"`
+	Limits     limits            `json:"limits"`
+	Daemon     *daemon           `json:"daemon,omitempty"`
+	Lint       string            `json:"lint,omitempty"`
+	Egress     string            `json:"egress,omitempty"`
+	Network    *networkPolicy    `json:"network,omitempty"`
+	Packages   *packages         `json:"packages,omitempty"`
+	Caches     map[string]string `json:"caches,omitempty"`
+	// Cacheable envs replay the result of the identical runs before them
+	// rather than running the code again, for the runs with no network.
+	Cacheable bool      `json:"cacheable,omitempty"`
+	Versions  []version `json:"versions,omitempty"`
+	Compat    compat    `json:"compat"`
+	Samples   []sample  `json:"samples"`
+	path      string
+}
+
+// envPaths are the directories envs are loaded from: the envs themselves, the
+// templates they can extend, and the front end whose Ace modes they use.
+type envPaths struct {
+	Envs      string
+	Templates string
+	Front     string
+}
+
+var defaultPaths = envPaths{
+	Envs:      "envs",
+	Templates: "templates",
+	Front:     "front",
+}
+
+const templatePrefix = "template:"
+
+// versions returns the versions declared by the env, or a single unnamed
+// default version when it declares none.
+func (l env) versions() []version {
+	if len(l.Versions) == 0 {
+		return []version{{Name: l.Name, Default: true}}
+	}
+	return l.Versions
+}
+
+// unchanged tells whether req runs the sample s of l as is: its file byte
+// for byte, and no other file.
+func (s sample) unchanged(l env, req request) bool {
+	code, err := ioutil.ReadFile(filepath.Join(l.path, s.File))
+	return err == nil && string(code) == req.Code && len(req.Files) == 0
+}
+
+func (l env) findSample(ID string) (sample, error) {
+	for _, s := range l.Samples {
+		if s.ID == ID {
+			return s, nil
+		}
+	}
+	return sample{}, fmt.Errorf("invalid sample '%s' for env '%s'", ID, l.ID)
+}
+
+// findVersion returns the version with the given ID, or the default one when
+// ID is empty.
+func (l env) findVersion(ID string) (version, error) {
+	for _, v := range l.versions() {
+		if v.ID == ID || (ID == "" && v.Default) {
+			return v, nil
+		}
+	}
+	return version{}, fmt.Errorf("invalid version '%s' for env '%s'", ID, l.ID)
+}
+
+var envs = []env{}
+
+// lintError points at the config file, and the field inside it, that made an
+// env invalid.
+type lintError struct {
+	File  string
+	Field string
+	Msg   string
+}
+
+func (e lintError) Error() string {
+	if e.Field == "" {
+		return e.File + ": " + e.Msg
+	}
+	return e.File + ": " + e.Field + ": " + e.Msg
+}
+
+var (
+	tagPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	memoryPattern = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+)
+
+type lintErrors []error
+
+func (errs lintErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func parseEnvs() error {
+	parsed, err := loadEnvs(conf.Paths)
+	if err != nil {
+		return err
+	}
+	envs = parsed
+	return nil
+}
+
+// loadEnvs reads and validates every env found in p.Envs. All problems are
+// reported at once rather than stopping at the first one.
+func loadEnvs(p envPaths) ([]env, error) {
+	infos, err := ioutil.ReadDir(p.Envs)
+	if err != nil {
+		return nil, err
+	}
+	loaded := []env{}
+	errs := lintErrors{}
+	seen := map[string]string{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		path := filepath.Join(p.Envs, info.Name())
+		l, lerrs := loadEnv(path, p)
+		errs = append(errs, lerrs...)
+		if len(lerrs) > 0 {
+			continue
+		}
+		config := filepath.Join(path, "config.json")
+		if other, ok := seen[l.ID]; ok {
+			errs = append(errs, lintError{config, "id", fmt.Sprintf("'%s' is already used by %s", l.ID, other)})
+			continue
+		}
+		seen[l.ID] = config
+		for _, name := range l.Compat.Piston {
+			if other, ok := seen["piston:"+name]; ok {
+				errs = append(errs, lintError{config, "compat.piston", fmt.Sprintf("'%s' is already used by %s", name, other)})
+			}
+			seen["piston:"+name] = config
+		}
+		for _, ID := range sortedJudge0(l.Compat.Judge0) {
+			key := fmt.Sprintf("judge0:%d", ID)
+			if other, ok := seen[key]; ok {
+				errs = append(errs, lintError{config, "compat.judge0", fmt.Sprintf("%d is already used by %s", ID, other)})
+			}
+			seen[key] = config
+		}
+		loaded = append(loaded, l)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].Name < loaded[j].Name
+	})
+	return loaded, nil
+}
+
+func loadEnv(path string, p envPaths) (env, []error) {
+	config := filepath.Join(path, "config.json")
+	merged, errs := readConfig(config, p, nil)
+	if len(errs) > 0 {
+		return env{}, errs
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return env{}, []error{err}
+	}
+	l := env{
+		ID:   filepath.Base(path),
+		path: path,
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return env{}, []error{lintError{File: config, Msg: err.Error()}}
+	}
+	if l.Mode == "" {
+		l.Mode = l.ID
+	}
+	if len(l.Versions) == 1 {
+		l.Versions[0].Default = true
+	}
+	for i, s := range l.Samples {
+		if s.ID == "" {
+			l.Samples[i].ID = strings.TrimSuffix(s.File, filepath.Ext(s.File))
+		}
+	}
+	return l, validateEnv(l, config, p.Front)
+}
+
+// readConfig reads a config and everything it extends, either another env or
+// a template, and merges them so that the closest config wins. chain holds
+// the configs already visited, to detect cycles.
+func readConfig(config string, p envPaths, chain []string) (map[string]interface{}, []error) {
+	data, err := ioutil.ReadFile(config)
+	if err != nil {
+		return nil, []error{err}
+	}
+	if err := decodeStrict(data, &env{}); err != nil {
+		return nil, []error{lintError{File: config, Msg: err.Error()}}
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, []error{lintError{File: config, Msg: err.Error()}}
+	}
+	parentName, _ := raw["extends"].(string)
+	delete(raw, "extends")
+	if parentName == "" {
+		return raw, nil
+	}
+	parent := filepath.Join(p.Envs, parentName, "config.json")
+	if strings.HasPrefix(parentName, templatePrefix) {
+		parent = filepath.Join(p.Templates, strings.TrimPrefix(parentName, templatePrefix), "config.json")
+	}
+	if strings.Contains(strings.TrimPrefix(parentName, templatePrefix), "..") {
+		return nil, []error{lintError{config, "extends", fmt.Sprintf("'%s' is not a valid env or template name", parentName)}}
+	}
+	chain = append(chain, config)
+	for _, c := range chain {
+		if filepath.Clean(c) == filepath.Clean(parent) {
+			return nil, []error{lintError{config, "extends", fmt.Sprintf("'%s' extends itself through %s", parentName, strings.Join(chain, " -> "))}}
+		}
+	}
+	if _, err := os.Stat(parent); err != nil {
+		return nil, []error{lintError{config, "extends", fmt.Sprintf("'%s' is neither an env nor a template", parentName)}}
+	}
+	base, errs := readConfig(parent, p, chain)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	delete(base, "id")
+	return mergeConfig(base, raw), nil
+}
+
+// mergeConfig overlays over on base: objects are merged key by key, anything
+// else, arrays included, is replaced.
+func mergeConfig(base, over map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range over {
+		bm, bok := merged[k].(map[string]interface{})
+		om, ook := v.(map[string]interface{})
+		if bok && ook {
+			merged[k] = mergeConfig(bm, om)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
+
+// decodeStrict unmarshals a config, refusing unknown fields and trailing data,
+// and turns offsets into line:column positions.
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		if _, terr := dec.Token(); terr != io.EOF {
+			return fmt.Errorf("unexpected data after the closing brace")
+		}
+	}
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("%s: %v", position(data, e.Offset), e)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("%s: %s: expected %s, got %s", position(data, e.Offset), e.Field, e.Type, e.Value)
+	}
+	return err
+}
+
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("%d:%d", line, col)
+}
+
+func validateEnv(l env, config, front string) []error {
+	errs := []error{}
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, lintError{config, field, fmt.Sprintf(format, args...)})
+	}
+	if l.ID == "" {
+		fail("id", "must not be empty")
+	}
+	if l.Name == "" {
+		fail("name", "is required")
+	}
+	if l.File == "" && l.Entrypoint == nil {
+		fail("file", "is required unless an entrypoint is detected")
+	} else if l.File != "" && filepath.Base(l.File) != l.File {
+		fail("file", "'%s' must be a plain file name", l.File)
+	}
+	if l.Entrypoint != nil {
+		problems := l.Entrypoint.validate()
+		for _, k := range sortedKeys(problems) {
+			fail("entrypoint."+k, "%s", problems[k])
+		}
+	}
+	if l.Daemon != nil {
+		problems := l.Daemon.validate()
+		for _, k := range sortedKeys(problems) {
+			fail("daemon."+k, "%s", problems[k])
+		}
+	}
+	if l.Egress != "" && l.Egress != egressDeny && l.Egress != egressReplay {
+		fail("egress", "'%s' is neither deny nor replay", l.Egress)
+	}
+	if l.Network != nil {
+		problems := l.Network.validate()
+		for _, k := range sortedKeys(problems) {
+			fail("network."+k, "%s", problems[k])
+		}
+		if l.Egress != "" {
+			fail("network", "cannot be used along with egress")
+		}
+	}
+	if l.Packages != nil {
+		problems := l.Packages.validate()
+		for _, k := range sortedKeys(problems) {
+			fail("packages."+k, "%s", problems[k])
+		}
+	}
+	if len(l.Caches) > 0 {
+		problems := validateCaches(l.Caches)
+		for _, k := range sortedKeys(problems) {
+			fail("caches."+k, "%s", problems[k])
+		}
+		if l.Daemon != nil {
+			fail("caches", "cannot be used along with daemon")
+		}
+	}
+	if l.Cacheable && l.Daemon != nil {
+		fail("cacheable", "cannot be used along with daemon")
+	} else if l.Cacheable && l.Egress != egressDeny && (l.Network == nil || l.Network.Policy != networkNone) {
+		fail("cacheable", "only runs with no network are cached, set egress to deny or the network policy to none")
+	}
+	if l.Lint != "" && linters[l.Lint] == nil {
+		fail("lint", "'%s' is not a known linter, e.g. dockerfile", l.Lint)
+	}
+	if _, err := os.Stat(filepath.Join(front, "ace-builds", "src-noconflict", "mode-"+l.Mode+".js")); err != nil {
+		fail("mode", "'%s' is not a known Ace mode", l.Mode)
+	}
+	if _, err := os.Stat(filepath.Join(l.path, "Dockerfile")); err != nil {
+		errs = append(errs, lintError{File: filepath.Join(l.path, "Dockerfile"), Msg: "is missing"})
+	}
+	problems := l.Limits.validate()
+	for _, k := range sortedKeys(problems) {
+		fail("limits."+k, "%s", problems[k])
+	}
+	versions := map[string]int{}
+	defaults := 0
+	for i, v := range l.Versions {
+		field := fmt.Sprintf("versions[%d]", i)
+		if !tagPattern.MatchString(v.ID) {
+			fail(field+".id", "'%s' is not a valid image tag", v.ID)
+		} else if j, ok := versions[v.ID]; ok {
+			fail(field+".id", "'%s' is already used by versions[%d]", v.ID, j)
+		} else {
+			versions[v.ID] = i
+		}
+		if v.Name == "" {
+			fail(field+".name", "is required")
+		}
+		if v.Default {
+			defaults++
+		}
+		if v.Packages != nil {
+			if l.Packages == nil {
+				fail(field+".packages", "only envs with packages use package caches")
+			} else if v.Default && !*v.Packages && packageManagers[l.Packages.Manager].Shared {
+				fail(field+".packages", "the default version seeds the package cache, it cannot go without it")
+			}
+		}
+	}
+	if len(l.Versions) > 0 && defaults != 1 {
+		fail("versions", "exactly one version must be the default, got %d", defaults)
+	}
+	judge0 := map[string]int{}
+	for _, ID := range sortedJudge0(l.Compat.Judge0) {
+		field := fmt.Sprintf("compat.judge0.%d", ID)
+		v, err := l.findVersion(l.Compat.Judge0[ID])
+		if err != nil {
+			fail(field, "'%s' is not a version of the env", l.Compat.Judge0[ID])
+		} else if other, ok := judge0[v.ID]; ok {
+			fail(field, "runs the same version as %d", other)
+		} else {
+			judge0[v.ID] = ID
+		}
+	}
+	if len(l.Samples) == 0 {
+		fail("samples", "at least one sample is required")
+	}
+	names := map[string]int{}
+	ids := map[string]int{}
+	for i, s := range l.Samples {
+		field := fmt.Sprintf("samples[%d]", i)
+		if !tagPattern.MatchString(s.ID) {
+			fail(field+".id", "'%s' is not a valid sample ID", s.ID)
+		} else if j, ok := ids[s.ID]; ok {
+			fail(field+".id", "'%s' is already used by samples[%d]", s.ID, j)
+		} else {
+			ids[s.ID] = i
+		}
+		if s.Name == "" {
+			fail(field+".name", "is required")
+		} else if j, ok := names[s.Name]; ok {
+			fail(field+".name", "'%s' is already used by samples[%d]", s.Name, j)
+		} else {
+			names[s.Name] = i
+		}
+		if s.File == "" {
+			fail(field+".file", "is required")
+		} else if err := checkEnvFile(l.path, s.File); err != nil {
+			fail(field+".file", "%v", err)
+		}
+		if s.Input != "" {
+			if err := checkEnvFile(l.path, s.Input); err != nil {
+				fail(field+".input", "%v", err)
+			}
+		}
+		if s.Egress != "" && s.Egress != egressDeny && s.Egress != egressReplay {
+			fail(field+".egress", "'%s' is neither deny nor replay", s.Egress)
+		}
+		egress := s.Egress
+		if egress == "" {
+			egress = l.Egress
+		}
+		if s.Fixtures != "" {
+			if egress != egressReplay {
+				fail(field+".fixtures", "only replay egress uses fixtures")
+			} else if filepath.Base(s.Fixtures) != s.Fixtures {
+				fail(field+".fixtures", "'%s' must be a plain file name", s.Fixtures)
+			} else if !conf.EgressRecord {
+				// Recording writes the fixtures, which only replays need.
+				if err := checkEnvFile(l.path, s.Fixtures); err != nil {
+					fail(field+".fixtures", "%v", err)
+				}
+			}
+		}
+		if s.Dependencies != "" {
+			if l.Packages == nil {
+				fail(field+".dependencies", "only envs with packages use dependency files")
+			} else if err := checkEnvFile(l.path, s.Dependencies); err != nil {
+				fail(field+".dependencies", "%v", err)
+			}
+		}
+		if s.Network != nil {
+			problems := s.Network.validate()
+			for _, k := range sortedKeys(problems) {
+				fail(field+".network."+k, "%s", problems[k])
+			}
+			if l.Egress != "" || s.Egress != "" {
+				fail(field+".network", "cannot be used along with egress")
+			}
+		}
+	}
+	return errs
+}
+
+// checkEnvFile makes sure a file referenced by a config exists and stays
+// inside the env directory.
+func checkEnvFile(dir, name string) error {
+	clean := filepath.ToSlash(filepath.Clean(name))
+	if filepath.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("'%s' is outside of the env directory", name)
+	}
+	info, err := os.Stat(filepath.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("'%s' does not exist", name)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("'%s' is a directory", name)
+	}
+	return nil
+}
+
+func envsCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dtc envs lint|new [flags]")
+		return 2
+	}
+	switch args[0] {
+	case "new":
+		return scaffoldCommand(args[1:])
+	case "lint":
+		p := defaultPaths
+		flags := flag.NewFlagSet("envs lint", flag.ContinueOnError)
+		flags.StringVar(&p.Envs, "envs", p.Envs, "directory of the envs")
+		flags.StringVar(&p.Templates, "templates", p.Templates, "directory of the env templates")
+		flags.StringVar(&p.Front, "front", p.Front, "directory of the front end")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		parsed, err := loadEnvs(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%d envs OK\n", len(parsed))
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown envs command '%s'\n", args[0])
+	return 2
+}
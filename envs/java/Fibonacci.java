@@ -0,0 +1,20 @@
+public class Fibonacci {
+    static int fibonacci(int n) {
+        if (n < 2) {
+            return n;
+        }
+        int a = 0, b = 1;
+        for (int i = 2; i <= n; i++) {
+            int c = a + b;
+            a = b;
+            b = c;
+        }
+        return b;
+    }
+
+    public static void main(String[] args) {
+        for (int i = 0; i <= 9; i++) {
+            System.out.print(fibonacci(i) + " ");
+        }
+    }
+}
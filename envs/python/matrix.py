@@ -0,0 +1,5 @@
+import numpy as np
+
+a = np.array([[1, 2], [3, 4]])
+print(a @ a)
+print(np.linalg.inv(a))
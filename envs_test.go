@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testEnvDir writes files to a new env directory, and returns it along with
+// a front end directory knowing the python Ace mode.
+func testEnvDir(t *testing.T, files map[string]string) (string, string) {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	front := t.TempDir()
+	modes := filepath.Join(front, "ace-builds", "src-noconflict")
+	if err := os.MkdirAll(modes, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(modes, "mode-python.js"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, front
+}
+
+func TestCheckEnvFile(t *testing.T) {
+	dir, _ := testEnvDir(t, map[string]string{"hello.py": "", "data/input.txt": "", "..data.txt": ""})
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"hello.py", ""},
+		{"data/input.txt", ""},
+		{"data/../hello.py", ""},
+		{"..data.txt", ""},
+		{"missing.py", "'missing.py' does not exist"},
+		{"data", "'data' is a directory"},
+		{"..", "'..' is outside of the env directory"},
+		{"../hello.py", "'../hello.py' is outside of the env directory"},
+		{"data/../../hello.py", "'data/../../hello.py' is outside of the env directory"},
+		{"/etc/passwd", "'/etc/passwd' is outside of the env directory"},
+	}
+	for _, test := range tests {
+		err := checkEnvFile(dir, test.name)
+		if got := errString(err); got != test.err {
+			t.Errorf("checkEnvFile(%q) = %q, want %q", test.name, got, test.err)
+		}
+	}
+}
+
+func TestValidateEnvFixtures(t *testing.T) {
+	dir, front := testEnvDir(t, map[string]string{"Dockerfile": "", "weather.py": "", "weather.json": "{}"})
+	defer func(record bool) { conf.EgressRecord = record }(conf.EgressRecord)
+	tests := []struct {
+		name   string
+		egress string
+		sample sample
+		record bool
+		errs   []string
+	}{
+		{"recorded", egressReplay, sample{Fixtures: "weather.json"}, false, nil},
+		{"missing", egressReplay, sample{Fixtures: "missing.json"}, false, []string{"samples[0].fixtures: 'missing.json' does not exist"}},
+		{"missing while recording", egressReplay, sample{Fixtures: "missing.json"}, true, nil},
+		{"sample replay", "", sample{Egress: egressReplay, Fixtures: "weather.json"}, false, nil},
+		{"sample replay missing", "", sample{Egress: egressReplay, Fixtures: "missing.json"}, false, []string{"samples[0].fixtures: 'missing.json' does not exist"}},
+		{"not replayed", egressDeny, sample{Fixtures: "weather.json"}, false, []string{"samples[0].fixtures: only replay egress uses fixtures"}},
+		{"not a file name", egressReplay, sample{Fixtures: "../weather.json"}, false, []string{"samples[0].fixtures: '../weather.json' must be a plain file name"}},
+	}
+	for _, test := range tests {
+		conf.EgressRecord = test.record
+		s := test.sample
+		s.ID, s.Name, s.File = "weather", "Weather", "weather.py"
+		l := env{ID: "python", Name: "Python", Mode: "python", File: "main.py", Egress: test.egress, Samples: []sample{s}, path: dir}
+		errs := []string{}
+		for _, err := range validateEnv(l, "config.json", front) {
+			errs = append(errs, err.(lintError).Field+": "+err.(lintError).Msg)
+		}
+		if len(test.errs) == 0 {
+			test.errs = []string{}
+		}
+		if !reflect.DeepEqual(errs, test.errs) {
+			t.Errorf("%s: validateEnv() = %q, want %q", test.name, errs, test.errs)
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestValidateEnvVersionPackages(t *testing.T) {
+	dir, front := testEnvDir(t, map[string]string{"Dockerfile": "", "hello.py": ""})
+	off := false
+	tests := []struct {
+		name     string
+		packages *packages
+		versions []version
+		errs     []string
+	}{
+		{"old version without", &packages{Manager: "go", Allow: []string{"a"}}, []version{{ID: "old", Name: "Old", Packages: &off}, {ID: "new", Name: "New", Default: true}}, nil},
+		{"default without", &packages{Manager: "go", Allow: []string{"a"}}, []version{{ID: "old", Name: "Old"}, {ID: "new", Name: "New", Default: true, Packages: &off}}, []string{"versions[1].packages: the default version seeds the package cache, it cannot go without it"}},
+		{"default without unshared", &packages{Manager: "pip", Allow: []string{"a"}}, []version{{ID: "old", Name: "Old"}, {ID: "new", Name: "New", Default: true, Packages: &off}}, nil},
+		{"no packages", nil, []version{{ID: "old", Name: "Old", Packages: &off}, {ID: "new", Name: "New", Default: true}}, []string{"versions[0].packages: only envs with packages use package caches"}},
+	}
+	for _, test := range tests {
+		l := env{ID: "python", Name: "Python", Mode: "python", File: "main.py", Packages: test.packages, Versions: test.versions, Samples: []sample{{ID: "hello", Name: "Hello", File: "hello.py"}}, path: dir}
+		errs := []string{}
+		for _, err := range validateEnv(l, "config.json", front) {
+			errs = append(errs, err.(lintError).Field+": "+err.(lintError).Msg)
+		}
+		if len(test.errs) == 0 {
+			test.errs = []string{}
+		}
+		if !reflect.DeepEqual(errs, test.errs) {
+			t.Errorf("%s: validateEnv() = %q, want %q", test.name, errs, test.errs)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// grpcMaxMessage is the largest message accepted, the default of gRPC.
+const grpcMaxMessage = 4 << 20
+
+// Status codes of gRPC.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+)
+
+type grpcError struct {
+	Code int
+	Msg  string
+}
+
+func (e grpcError) Error() string {
+	return e.Msg
+}
+
+// grpcServer serves the gRPC API of proto/dtc.proto on addr, over HTTP/2
+// without TLS.
+func grpcServer(addr string) *http.Server {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:      addr,
+		Handler:   http.HandlerFunc(grpcHandler),
+		Protocols: protocols,
+	}
+}
+
+// grpcHandler serves the dtc.v1.Runner service. The status of every call is
+// sent in the trailers, as gRPC requires.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		httpError(w, http.StatusUnsupportedMediaType, fmt.Errorf("only gRPC calls are served here"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	var err error
+	switch r.URL.Path {
+	case "/dtc.v1.Runner/ListEnvs":
+		err = grpcUnary(w, r, grpcListEnvs)
+	case "/dtc.v1.Runner/GetSample":
+		err = grpcUnary(w, r, grpcGetSample)
+	case "/dtc.v1.Runner/Cancel":
+		err = grpcUnary(w, r, grpcCancel)
+	case "/dtc.v1.Runner/Run":
+		err = grpcRun(w, r)
+	default:
+		err = grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)}
+	}
+	code, msg := grpcOK, ""
+	if e, ok := err.(grpcError); ok {
+		code, msg = e.Code, e.Msg
+	} else if err != nil {
+		code, msg = grpcInternal, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(msg))
+	}
+}
+
+// grpcPercentEncode encodes the message of a status as gRPC requires: the
+// bytes of its UTF-8 that are not printable ASCII, and %, are written %XX.
+func grpcPercentEncode(msg string) string {
+	const hex = "0123456789ABCDEF"
+	b := strings.Builder{}
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readGRPCMessage reads one length-prefixed message. It returns io.EOF when
+// the client is done sending.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcError{grpcResourceExhausted, fmt.Sprintf("message of %d bytes is too large", size)}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, grpcError{grpcInvalidArgument, "truncated message"}
+	}
+	return buf, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, m *pbWriter) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(m.buf)))
+	if _, err := w.Write(append(prefix, m.buf...)); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+func grpcUnary(w http.ResponseWriter, r *http.Request, call func([]byte) (*pbWriter, error)) error {
+	msg, err := readGRPCMessage(r.Body)
+	if err == io.EOF {
+		return grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := call(msg)
+	if err != nil {
+		return err
+	}
+	return writeGRPCMessage(w, resp)
+}
+
+// pbStrings decodes a message made of string fields only.
+func pbStrings(buf []byte) (map[int]string, error) {
+	fields, err := pbFields(buf)
+	if err != nil {
+		return nil, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	values := map[int]string{}
+	for _, f := range fields {
+		if f.Wire == wireBytes {
+			values[f.Num] = string(f.Bytes)
+		}
+	}
+	return values, nil
+}
+
+func grpcListEnvs([]byte) (*pbWriter, error) {
+	resp := &pbWriter{}
+	for _, l := range envStatuses() {
+		m := &pbWriter{}
+		m.string(1, l.ID)
+		m.string(2, l.Name)
+		m.string(3, l.Mode)
+		m.string(4, l.File)
+		for _, v := range l.Versions {
+			vm := &pbWriter{}
+			vm.string(1, v.ID)
+			vm.string(2, v.Name)
+			vm.bool(3, v.Default)
+			vm.bool(4, v.Available)
+			vm.string(5, v.Status)
+			m.message(5, vm)
+		}
+		for _, s := range l.Samples {
+			sm := &pbWriter{}
+			sm.string(1, s.ID)
+			sm.string(2, s.Name)
+			sm.bool(3, s.Input != "")
+			m.message(6, sm)
+		}
+		m.bool(7, l.Available)
+		m.string(8, l.Status)
+		resp.message(1, m)
+	}
+	return resp, nil
+}
+
+func grpcGetSample(msg []byte) (*pbWriter, error) {
+	values, err := pbStrings(msg)
+	if err != nil {
+		return nil, err
+	}
+	l, err := findEnv(values[1])
+	if err != nil {
+		return nil, grpcError{grpcNotFound, err.Error()}
+	}
+	s, err := l.findSample(values[2])
+	if err != nil {
+		return nil, grpcError{grpcNotFound, err.Error()}
+	}
+	code, err := ioutil.ReadFile(filepath.Join(l.path, s.File))
+	if err != nil {
+		return nil, err
+	}
+	resp := &pbWriter{}
+	resp.string(1, l.ID)
+	resp.string(2, s.ID)
+	resp.string(3, s.Name)
+	resp.string(4, string(code))
+	if s.Input != "" {
+		input, err := ioutil.ReadFile(filepath.Join(l.path, s.Input))
+		if err != nil {
+			return nil, err
+		}
+		if len(input) > 0 {
+			resp.bytes(5, input)
+		}
+	}
+	return resp, nil
+}
+
+func grpcCancel(msg []byte) (*pbWriter, error) {
+	values, err := pbStrings(msg)
+	if err != nil {
+		return nil, err
+	}
+	run, ok := runs.get(values[1])
+	if !ok {
+		return nil, grpcError{grpcNotFound, fmt.Sprintf("invalid run '%s'", values[1])}
+	}
+	if !run.cancel() {
+		return nil, grpcError{grpcFailedPrecondition, fmt.Sprintf("run '%s' is already over", run.ID)}
+	}
+	return statusMessage(run.status()), nil
+}
+
+func statusMessage(s runStatus) *pbWriter {
+	m := &pbWriter{}
+	m.string(1, s.ID)
+	m.string(2, s.Env)
+	m.string(3, s.Version)
+	m.string(4, s.Status)
+	if s.ExitCode != nil {
+		m.varint(5, int64(*s.ExitCode))
+	}
+	m.bool(6, s.TimedOut)
+	m.bool(7, s.Cancelled)
+	m.string(8, s.Error)
+	m.int(9, s.DurationMs)
+	m.bool(10, s.Truncated)
+	return m
+}
+
+func decodeRunRequest(buf []byte) (request, error) {
+	fields, err := pbFields(buf)
+	if err != nil {
+		return request{}, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	req, input := request{}, []byte{}
+	for _, f := range fields {
+		if f.Wire != wireBytes {
+			continue
+		}
+		switch f.Num {
+		case 1:
+			req.Env = string(f.Bytes)
+		case 2:
+			req.Version = string(f.Bytes)
+		case 3:
+			req.Code = string(f.Bytes)
+		case 4:
+			input = f.Bytes
+		case 5:
+			values, err := pbStrings(f.Bytes)
+			if err != nil {
+				return request{}, err
+			}
+			req.Files = append(req.Files, requestFile{Name: values[1], Content: values[2]})
+		case 6:
+			req.Sample = string(f.Bytes)
+		}
+	}
+	req.Input = base64.StdEncoding.EncodeToString(input)
+	return req, nil
+}
+
+// runInput is a decoded RunInput message, of which one field is set.
+type runInput struct {
+	start      []byte
+	stdin      []byte
+	closeStdin bool
+}
+
+func decodeRunInput(buf []byte) (runInput, error) {
+	fields, err := pbFields(buf)
+	if err != nil {
+		return runInput{}, grpcError{grpcInvalidArgument, err.Error()}
+	}
+	in := runInput{}
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Wire == wireBytes:
+			in.start = f.Bytes
+		case f.Num == 2 && f.Wire == wireBytes:
+			in.stdin = f.Bytes
+		case f.Num == 3 && f.Wire == wireVarint:
+			in.closeStdin = f.Varint != 0
+		}
+	}
+	return in, nil
+}
+
+// outputMessage returns the RunOutput message of e, or nil if e is not sent.
+func outputMessage(e event) *pbWriter {
+	out := &pbWriter{}
+	switch e.Type {
+	case eventStdout:
+		out.bytes(2, e.text())
+	case eventStderr:
+		out.bytes(3, e.text())
+	case eventInfo, eventImage, eventLint:
+		out.bytes(4, []byte(e.Message))
+	case eventEgress:
+		if !e.Egress.blocked() {
+			return nil
+		}
+		out.bytes(4, []byte(e.Message))
+	default:
+		// Errors and exit codes are part of the final status.
+		return nil
+	}
+	out.int(5, int64(e.Seq))
+	return out
+}
+
+// grpcRun starts a run from the first message of the call and feeds the
+// following ones to its standard input, while streaming its output back.
+func grpcRun(w http.ResponseWriter, r *http.Request) error {
+	msg, err := readGRPCMessage(r.Body)
+	if err == io.EOF {
+		return grpcError{grpcInvalidArgument, "missing start message"}
+	}
+	if err != nil {
+		return err
+	}
+	in, err := decodeRunInput(msg)
+	if err != nil {
+		return err
+	}
+	start := in.start
+	if start == nil {
+		return grpcError{grpcInvalidArgument, "the first message must be a start one"}
+	}
+	req, err := decodeRunRequest(start)
+	if err != nil {
+		return err
+	}
+	if err := req.check(); err != nil {
+		return grpcError{grpcInvalidArgument, err.Error()}
+	}
+	stdin, stdinWriter := io.Pipe()
+	defer stdin.Close()
+	run := runs.startStdin(req, stdin)
+	go func() {
+		for {
+			msg, err := readGRPCMessage(r.Body)
+			if err == io.EOF {
+				stdinWriter.Close()
+				return
+			}
+			if err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			in, err := decodeRunInput(msg)
+			if err != nil {
+				stdinWriter.CloseWithError(err)
+				return
+			}
+			if in.stdin != nil {
+				stdinWriter.Write(in.stdin)
+			}
+			if in.closeStdin {
+				stdinWriter.Close()
+			}
+		}
+	}()
+	// The run does not outlive the call, unlike websocket ones which can be
+	// attached to again.
+	over := false
+	defer func() {
+		if !over {
+			run.cancel()
+		}
+	}()
+	out := &pbWriter{}
+	out.message(1, statusMessage(run.status()))
+	if err := writeGRPCMessage(w, out); err != nil {
+		return err
+	}
+	seq := 0
+	for {
+		events, done, update := run.follow(seq)
+		for _, e := range events {
+			seq = e.Seq
+			out := outputMessage(e)
+			if out == nil {
+				continue
+			}
+			if err := writeGRPCMessage(w, out); err != nil {
+				return err
+			}
+		}
+		if done {
+			over = true
+			out := &pbWriter{}
+			out.message(1, statusMessage(run.status()))
+			out.int(5, int64(seq))
+			return writeGRPCMessage(w, out)
+		}
+		select {
+		case <-update:
+		case <-r.Context().Done():
+			return grpcError{grpcCanceled, "the call was cancelled"}
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// protoField is a field of a message of proto/dtc.proto.
+type protoField struct {
+	Name     string
+	Type     string
+	Repeated bool
+}
+
+var protoFieldPattern = regexp.MustCompile(`^(repeated |optional )?(\w+) (\w+) = (\d+);$`)
+
+// readProto reads the messages of proto/dtc.proto, by name and field number,
+// so that the hand-written messages are checked against it.
+func readProto(t *testing.T) map[string]map[int]protoField {
+	f, err := os.Open(filepath.Join("proto", "dtc.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	messages := map[string]map[int]protoField{}
+	var fields map[int]protoField
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "message ") {
+			fields = map[int]protoField{}
+			messages[strings.Fields(line)[1]] = fields
+			continue
+		}
+		m := protoFieldPattern.FindStringSubmatch(line)
+		if m == nil || fields == nil {
+			continue
+		}
+		num, _ := strconv.Atoi(m[4])
+		fields[num] = protoField{Name: m[3], Type: m[2], Repeated: m[1] == "repeated "}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// protoWire returns the wire type of the fields of type typ.
+func protoWire(typ string) int {
+	switch typ {
+	case "bool", "int32", "int64":
+		return wireVarint
+	}
+	return wireBytes
+}
+
+// decodeProto decodes buf as the message name of proto, by field name. It
+// fails on the fields proto does not declare, or with another wire type.
+func decodeProto(t *testing.T, proto map[string]map[int]protoField, name string, buf []byte) map[string]interface{} {
+	t.Helper()
+	fields, err := pbFields(buf)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	values := map[string]interface{}{}
+	for _, f := range fields {
+		pf, ok := proto[name][f.Num]
+		if !ok {
+			t.Errorf("%s: field %d is not in the proto", name, f.Num)
+			continue
+		}
+		if want := protoWire(pf.Type); f.Wire != want {
+			t.Errorf("%s.%s: wire type %d, want %d", name, pf.Name, f.Wire, want)
+			continue
+		}
+		var v interface{}
+		switch pf.Type {
+		case "bool":
+			v = f.Varint != 0
+		case "int32":
+			v = int64(int32(f.Varint))
+		case "int64":
+			v = int64(f.Varint)
+		case "string", "bytes":
+			v = string(f.Bytes)
+		default:
+			v = decodeProto(t, proto, pf.Type, f.Bytes)
+		}
+		if pf.Repeated {
+			list, _ := values[pf.Name].([]interface{})
+			values[pf.Name] = append(list, v)
+		} else {
+			if _, ok := values[pf.Name]; ok {
+				t.Errorf("%s.%s: written twice", name, pf.Name)
+			}
+			values[pf.Name] = v
+		}
+	}
+	return values
+}
+
+// encodeProto encodes values as the message name of proto, as a client would.
+func encodeProto(t *testing.T, proto map[string]map[int]protoField, name string, values map[string]interface{}) []byte {
+	t.Helper()
+	w := &pbWriter{}
+	nums := []int{}
+	for num := range proto[name] {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	written := 0
+	for _, num := range nums {
+		pf := proto[name][num]
+		value, ok := values[pf.Name]
+		if !ok {
+			continue
+		}
+		written++
+		list := []interface{}{value}
+		if pf.Repeated {
+			list = value.([]interface{})
+		}
+		for _, v := range list {
+			switch pf.Type {
+			case "bool":
+				w.bool(num, v.(bool))
+			case "int32", "int64":
+				w.varint(num, v.(int64))
+			case "string", "bytes":
+				w.bytes(num, []byte(v.(string)))
+			default:
+				w.bytes(num, encodeProto(t, proto, pf.Type, v.(map[string]interface{})))
+			}
+		}
+	}
+	if written != len(values) {
+		t.Fatalf("%s: %v has fields the proto does not declare", name, values)
+	}
+	return w.buf
+}
+
+func TestProtoMessagesTested(t *testing.T) {
+	tested := []string{
+		"CancelRequest", "Env", "File", "GetSampleRequest", "ListEnvsRequest", "ListEnvsResponse",
+		"RunInput", "RunOutput", "RunRequest", "RunStatus", "Sample", "SampleInfo", "Version",
+	}
+	declared := []string{}
+	for name := range readProto(t) {
+		declared = append(declared, name)
+	}
+	sort.Strings(declared)
+	if !reflect.DeepEqual(declared, tested) {
+		t.Errorf("messages of the proto = %v, tested %v", declared, tested)
+	}
+}
+
+func TestGRPCListEnvs(t *testing.T) {
+	proto := readProto(t)
+	defer func(saved []env) { envs = saved }(envs)
+	envs = []env{{
+		ID:   "python",
+		Name: "Python",
+		Mode: "python",
+		File: "main.py",
+		Versions: []version{
+			{ID: "3.12", Name: "Python 3.12", Default: true},
+			{ID: "3.11", Name: "Python 3.11"},
+		},
+		Samples: []sample{
+			{ID: "hello", Name: "Hello", File: "hello.py"},
+			{ID: "echo", Name: "Echo", File: "echo.py", Input: "echo.txt"},
+		},
+	}}
+	images.mu.Lock()
+	images.images[imageKey("python", "3.12")] = &image{imageStatus: imageStatus{Status: imageReady}}
+	images.mu.Unlock()
+	defer func() {
+		images.mu.Lock()
+		delete(images.images, imageKey("python", "3.12"))
+		images.mu.Unlock()
+	}()
+	if got := decodeProto(t, proto, "ListEnvsRequest", encodeProto(t, proto, "ListEnvsRequest", nil)); len(got) != 0 {
+		t.Errorf("ListEnvsRequest = %v, want no field", got)
+	}
+	resp, err := grpcListEnvs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"envs": []interface{}{map[string]interface{}{
+		"id":   "python",
+		"name": "Python",
+		"mode": "python",
+		"file": "main.py",
+		"versions": []interface{}{
+			map[string]interface{}{"id": "3.12", "name": "Python 3.12", "default": true, "available": true, "status": imageReady},
+			map[string]interface{}{"id": "3.11", "name": "Python 3.11", "status": imagePending},
+		},
+		"samples": []interface{}{
+			map[string]interface{}{"id": "hello", "name": "Hello"},
+			map[string]interface{}{"id": "echo", "name": "Echo", "has_input": true},
+		},
+		"available": true,
+		"status":    imageReady,
+	}}}
+	if got := decodeProto(t, proto, "ListEnvsResponse", resp.buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListEnvsResponse =\n%#v\nwant\n%#v", got, want)
+	}
+}
+
+func TestGRPCGetSample(t *testing.T) {
+	proto := readProto(t)
+	dir := t.TempDir()
+	for name, content := range map[string]string{"echo.py": "print(input())\n", "echo.txt": "hi\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(saved []env) { envs = saved }(envs)
+	envs = []env{{ID: "python", Samples: []sample{{ID: "echo", Name: "Echo", File: "echo.py", Input: "echo.txt"}}, path: dir}}
+	req := encodeProto(t, proto, "GetSampleRequest", map[string]interface{}{"env": "python", "sample": "echo"})
+	resp, err := grpcGetSample(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"env": "python", "id": "echo", "name": "Echo", "code": "print(input())\n", "input": "hi\n"}
+	if got := decodeProto(t, proto, "Sample", resp.buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("Sample = %v, want %v", got, want)
+	}
+	req = encodeProto(t, proto, "GetSampleRequest", map[string]interface{}{"env": "python", "sample": "missing"})
+	if _, err := grpcGetSample(req); err == nil || err.(grpcError).Code != grpcNotFound {
+		t.Errorf("grpcGetSample() of a missing sample = %v, want a not found error", err)
+	}
+}
+
+func TestGRPCStatusMessage(t *testing.T) {
+	proto := readProto(t)
+	exitCode, negative := 0, -1
+	tests := []struct {
+		status runStatus
+		want   map[string]interface{}
+	}{
+		{
+			runStatus{ID: "a", Env: "python", Version: "3.12", Status: runDone, ExitCode: &exitCode, TimedOut: true, Cancelled: true, Error: "oops", DurationMs: 1500, Truncated: true},
+			map[string]interface{}{"id": "a", "env": "python", "version": "3.12", "status": runDone, "exit_code": int64(0), "timed_out": true, "cancelled": true, "error": "oops", "duration_ms": int64(1500), "truncated": true},
+		},
+		{
+			runStatus{ID: "b", Env: "python", Status: runDone, ExitCode: &negative},
+			map[string]interface{}{"id": "b", "env": "python", "status": runDone, "exit_code": int64(-1)},
+		},
+		{
+			runStatus{ID: "c", Env: "python", Status: runPending},
+			map[string]interface{}{"id": "c", "env": "python", "status": runPending},
+		},
+	}
+	for _, test := range tests {
+		if got := decodeProto(t, proto, "RunStatus", statusMessage(test.status).buf); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RunStatus of %s = %v, want %v", test.status.ID, got, test.want)
+		}
+	}
+}
+
+func TestGRPCOutputMessage(t *testing.T) {
+	proto := readProto(t)
+	tests := []struct {
+		event event
+		want  map[string]interface{}
+	}{
+		{event{Seq: 1, Type: eventStdout, Data: []byte("out\n")}, map[string]interface{}{"stdout": "out\n", "seq": int64(1)}},
+		{event{Seq: 2, Type: eventStderr, Data: []byte("err\n"), Service: "db"}, map[string]interface{}{"stderr": "db | err\n", "seq": int64(2)}},
+		{event{Seq: 3, Type: eventStdout}, map[string]interface{}{"stdout": "", "seq": int64(3)}},
+		{event{Seq: 4, Type: eventInfo, Message: "killed"}, map[string]interface{}{"info": "killed", "seq": int64(4)}},
+		{event{Seq: 5, Type: eventEgress, Message: "denied", Egress: &egressEvent{Action: egressDenied}}, map[string]interface{}{"info": "denied", "seq": int64(5)}},
+		{event{Seq: 6, Type: eventEgress, Message: "allowed", Egress: &egressEvent{Action: egressAllowed}}, nil},
+		{event{Seq: 7, Type: eventExit}, nil},
+	}
+	for _, test := range tests {
+		out := outputMessage(test.event)
+		if out == nil {
+			if test.want != nil {
+				t.Errorf("outputMessage() of event %d = nil, want %v", test.event.Seq, test.want)
+			}
+			continue
+		}
+		if got := decodeProto(t, proto, "RunOutput", out.buf); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RunOutput of event %d = %v, want %v", test.event.Seq, got, test.want)
+		}
+	}
+	exitCode := 0
+	out := &pbWriter{}
+	out.message(1, statusMessage(runStatus{ID: "a", Env: "python", Status: runDone, ExitCode: &exitCode}))
+	out.int(5, 8)
+	want := map[string]interface{}{
+		"status": map[string]interface{}{"id": "a", "env": "python", "status": runDone, "exit_code": int64(0)},
+		"seq":    int64(8),
+	}
+	if got := decodeProto(t, proto, "RunOutput", out.buf); !reflect.DeepEqual(got, want) {
+		t.Errorf("RunOutput of the final status = %v, want %v", got, want)
+	}
+}
+
+func TestGRPCRunInput(t *testing.T) {
+	proto := readProto(t)
+	start := map[string]interface{}{
+		"env":     "python",
+		"version": "3.12",
+		"code":    "print(input())\n",
+		"input":   "hi\n",
+		"files": []interface{}{
+			map[string]interface{}{"name": "a.py", "content": "a = 1\n"},
+			map[string]interface{}{"name": "b.py"},
+		},
+		"sample": "echo",
+	}
+	in, err := decodeRunInput(encodeProto(t, proto, "RunInput", map[string]interface{}{"start": start}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := decodeRunRequest(in.start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := request{
+		Env:     "python",
+		Version: "3.12",
+		Code:    "print(input())\n",
+		Input:   base64.StdEncoding.EncodeToString([]byte("hi\n")),
+		Files:   []requestFile{{Name: "a.py", Content: "a = 1\n"}, {Name: "b.py"}},
+		Sample:  "echo",
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("decodeRunRequest() = %#v, want %#v", req, want)
+	}
+	tests := []struct {
+		values map[string]interface{}
+		want   runInput
+	}{
+		{map[string]interface{}{"stdin": "more\n"}, runInput{stdin: []byte("more\n")}},
+		{map[string]interface{}{"stdin": ""}, runInput{stdin: []byte{}}},
+		{map[string]interface{}{"close_stdin": true}, runInput{closeStdin: true}},
+	}
+	for _, test := range tests {
+		got, err := decodeRunInput(encodeProto(t, proto, "RunInput", test.values))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decodeRunInput(%v) = %#v, want %#v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestGRPCCancelRequest(t *testing.T) {
+	proto := readProto(t)
+	values, err := pbStrings(encodeProto(t, proto, "CancelRequest", map[string]interface{}{"id": "abc"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[1] != "abc" {
+		t.Errorf("id = %q, want %q", values[1], "abc")
+	}
+}
+
+func TestGRPCPercentEncode(t *testing.T) {
+	tests := []struct {
+		msg, want string
+	}{
+		{"invalid env 'go'", "invalid env 'go'"},
+		{"100% done", "100%25 done"},
+		{"line\nbreak\t", "line%0Abreak%09"},
+		{"café ☕", "caf%C3%A9 %E2%98%95"},
+		{"~ \x7f", "~ %7F"},
+	}
+	for _, test := range tests {
+		if got := grpcPercentEncode(test.msg); got != test.want {
+			t.Errorf("grpcPercentEncode(%q) = %q, want %q", test.msg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hashLabel = "dtc.hash"
+
+const (
+	imagePending  = "pending"
+	imageBuilding = "building"
+	imageReady    = "ready"
+	imageFailed   = "failed"
+)
+
+type imageStatus struct {
+	Env     string `json:"env"`
+	Version string `json:"version,omitempty"`
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	// ID is the ID of the image once ready, which changes with its content.
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Packages is the status of the package cache of the image, if any, and
+	// Caches that of its build caches.
+	Packages string `json:"packages,omitempty"`
+	Caches   string `json:"caches,omitempty"`
+}
+
+// image tracks the docker image of one env: whether it can be used yet and
+// the output of its last build.
+type image struct {
+	imageStatus
+	dir    string
+	args   map[string]string
+	mu     sync.Mutex
+	log    []byte
+	update chan struct{}
+	// packages is the package cache of the runs of the image, if any, and
+	// caches their build caches.
+	packages *packageCache
+	caches   *buildCaches
+}
+
+func (img *image) Write(p []byte) (int, error) {
+	img.mu.Lock()
+	img.log = append(img.log, p...)
+	img.notify()
+	img.mu.Unlock()
+	return len(p), nil
+}
+
+// notify wakes up everyone following the image. Callers must hold img.mu.
+func (img *image) notify() {
+	close(img.update)
+	img.update = make(chan struct{})
+}
+
+func (img *image) setStatus(status string, err error) {
+	img.mu.Lock()
+	img.Status = status
+	img.Error = ""
+	if err != nil {
+		img.Error = err.Error()
+	}
+	img.notify()
+	img.mu.Unlock()
+}
+
+func (img *image) status() imageStatus {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	return img.imageStatus
+}
+
+func (img *image) ready() bool {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	return img.Status == imageReady
+}
+
+// follow returns the build log written after offset, whether the build is
+// over, and a channel closed on the next change.
+func (img *image) follow(offset int) ([]byte, bool, <-chan struct{}) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	done := img.Status == imageReady || img.Status == imageFailed
+	return img.log[offset:], done, img.update
+}
+
+type imageManager struct {
+	mu     sync.Mutex
+	images map[string]*image
+}
+
+var images = &imageManager{images: map[string]*image{}}
+
+func imageName(l env, v version) string {
+	if v.ID == "" {
+		return "dtc-" + l.ID
+	}
+	return "dtc-" + l.ID + ":" + v.ID
+}
+
+func imageKey(envID, versionID string) string {
+	return envID + "/" + versionID
+}
+
+func (m *imageManager) get(envID, versionID string) (*image, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	img, ok := m.images[imageKey(envID, versionID)]
+	return img, ok
+}
+
+func (m *imageManager) list() []*image {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*image, 0, len(m.images))
+	for _, img := range m.images {
+		list = append(list, img)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Env != list[j].Env {
+			return list[i].Env < list[j].Env
+		}
+		return list[i].Version < list[j].Version
+	})
+	return list
+}
+
+// ensure registers the image of every env and, in the background, builds the
+// ones that are missing or whose env directory changed since they were built,
+// then seeds their package caches and warms their build caches.
+func (m *imageManager) ensure(list []env) {
+	pending := []*image{}
+	caches := []*packageCache{}
+	warm := []*buildCaches{}
+	m.mu.Lock()
+	for _, l := range list {
+		imgs := map[string]*image{}
+		for _, v := range l.versions() {
+			img := &image{
+				imageStatus: imageStatus{
+					Env:     l.ID,
+					Version: v.ID,
+					Name:    imageName(l, v),
+					Status:  imagePending,
+				},
+				dir:    l.path,
+				args:   v.Args,
+				update: make(chan struct{}),
+			}
+			m.images[imageKey(l.ID, v.ID)] = img
+			imgs[v.ID] = img
+			pending = append(pending, img)
+			if len(l.Caches) > 0 {
+				warm = append(warm, newBuildCaches(l, v, img))
+			}
+		}
+		caches = append(caches, newPackageCaches(l, imgs)...)
+	}
+	m.mu.Unlock()
+	go func() {
+		for _, img := range pending {
+			if err := img.ensure(); err != nil {
+				slog.Error("cannot prepare the image", "image", img.Name, "err", err)
+			}
+		}
+		for _, cache := range caches {
+			if !cache.image.ready() {
+				cache.setStatus(packagesFailed, "", fmt.Errorf("the image %s is not ready", cache.image.Name))
+				continue
+			}
+			if err := cache.seed(); err != nil {
+				slog.Error("cannot seed the package cache", "image", cache.image.Name, "err", err)
+			}
+		}
+		for _, c := range warm {
+			if !c.image.ready() {
+				c.setStatus(cachesFailed, "", fmt.Errorf("the image %s is not ready", c.image.Name))
+				continue
+			}
+			if err := c.warm(); err != nil {
+				slog.Error("cannot warm the build caches", "image", c.image.Name, "err", err)
+			}
+		}
+	}()
+}
+
+func (img *image) ensure() error {
+	hash, err := hashDir(img.dir, img.args)
+	if err != nil {
+		img.setStatus(imageFailed, err)
+		return err
+	}
+	img.mu.Lock()
+	img.Hash = hash
+	img.mu.Unlock()
+	out, err := exec.Command(conf.Docker, "image", "inspect",
+		"--format", "{{ index .Config.Labels \""+hashLabel+"\" }}", img.Name).Output()
+	if err == nil && strings.TrimSpace(string(out)) == hash {
+		img.setReady()
+		return nil
+	}
+	img.setStatus(imageBuilding, nil)
+	slog.Info("building image", "image", img.Name, "dir", img.dir)
+	args := []string{"build", "-t", img.Name, "--label", hashLabel + "=" + hash}
+	args = append(args, labelArgs("", time.Now())...)
+	for _, k := range sortedKeys(img.args) {
+		args = append(args, "--build-arg", k+"="+img.args[k])
+	}
+	cmd := exec.Command(conf.Docker, append(args, img.dir)...)
+	cmd.Stdout = img
+	cmd.Stderr = img
+	if err := cmd.Run(); err != nil {
+		img.setStatus(imageFailed, err)
+		return err
+	}
+	img.setReady()
+	return nil
+}
+
+// setReady records that the image is ready, along with its ID.
+func (img *image) setReady() {
+	out, err := exec.Command(conf.Docker, "image", "inspect", "--format", "{{ .Id }}", img.Name).Output()
+	if err != nil {
+		slog.Error("cannot find the ID of the image", "image", img.Name, "err", err)
+	}
+	img.mu.Lock()
+	img.ID = strings.TrimSpace(string(out))
+	img.mu.Unlock()
+	img.setStatus(imageReady, nil)
+}
+
+// hashDir hashes the names and contents of every file under dir, which is
+// exactly the build context of the env image, along with the build arguments.
+func hashDir(dir string, args map[string]string) (string, error) {
+	h := sha256.New()
+	for _, k := range sortedKeys(args) {
+		fmt.Fprintf(h, "%s=%s\x00", k, args[k])
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), info.Size())
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func envAvailable(envID, versionID string) bool {
+	img, ok := images.get(envID, versionID)
+	return ok && img.ready()
+}
+
+// imagesHandler serves /admin/images/ with the status of every env image, and
+// /admin/images/<env>[/<version>] with the build log of one of them, streamed
+// until the build is over.
+func imagesHandler(w http.ResponseWriter, r *http.Request) {
+	ID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/images"), "/")
+	if ID == "" {
+		list := []imageStatus{}
+		for _, img := range images.list() {
+			list = append(list, img.status())
+		}
+		buf, err := json.Marshal(list)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, string(buf))
+		return
+	}
+	envID, versionID := ID, ""
+	if i := strings.Index(ID, "/"); i >= 0 {
+		envID, versionID = ID[:i], ID[i+1:]
+	}
+	if l, err := findEnv(envID); err == nil {
+		if v, err := l.findVersion(versionID); err == nil {
+			versionID = v.ID
+		}
+	}
+	img, ok := images.get(envID, versionID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "invalid image '%s'", ID)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	offset := 0
+	for {
+		buf, done, update := img.follow(offset)
+		offset += len(buf)
+		if _, err := w.Write(buf); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-update:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
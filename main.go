@@ -1,262 +1,319 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"sort"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/gorilla/websocket"
 )
 
 func main() {
-	fmt.Println("Parsing envs")
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(command(os.Args[1:]))
+	}
+	os.Exit(serve(os.Args[1:]))
+}
+
+// serve runs the server with the settings of args and the config.
+func serve(args []string) int {
+	if _, err := loadConfig("serve", args); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return 2
+	}
+	setupLogging()
+	if err := os.MkdirAll(conf.Workdir, 0777); err != nil {
+		slog.Error("cannot create the work directory", "err", err)
+		return 1
+	}
+	slog.Info("parsing envs", "dir", conf.Paths.Envs)
 	if err := parseEnvs(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		slog.Error("invalid envs", "err", err)
+		return 1
 	}
-	fmt.Println("Starting backend server on port 8080")
-	http.Handle("/", http.FileServer(http.Dir("front")))
+	images.ensure(envs)
+	slog.Info("reaping leftovers of runs", "instance", instanceID, "age", conf.ReaperAge, "interval", conf.ReaperInterval)
+	reaper.start(conf.ReaperInterval)
+	http.Handle("/", http.FileServer(http.Dir(conf.Paths.Front)))
 	http.HandleFunc("/run/", runHandler)
+	http.HandleFunc("/sse/", sseHandler)
 	http.HandleFunc("/data/", dataHandler)
 	http.HandleFunc("/envs/", envsHandler)
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	http.HandleFunc("/admin/images/", adminOnly(imagesHandler))
+	http.HandleFunc("/admin/reaper", adminOnly(reaperHandler))
+	http.HandleFunc("/admin/results", adminOnly(resultsHandler))
+	http.HandleFunc("/api/v1/", apiHandler)
+	http.HandleFunc("/compile", compileHandler)
+	http.HandleFunc("/fmt", fmtHandler)
+	http.HandleFunc("/submissions", judge0Handler)
+	http.HandleFunc("/submissions/", judge0Handler)
+	http.HandleFunc("/languages", judge0Handler)
+	http.HandleFunc("/api/v2/", pistonHandler)
+	servers := []*http.Server{{Addr: conf.Listen}}
+	if conf.GRPCListen != "" {
+		servers = append(servers, grpcServer(conf.GRPCListen))
 	}
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		slog.Info("starting server", "addr", server.Addr)
+		go func(server *http.Server) {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-failed:
+		slog.Error("server stopped", "err", err)
+		return 1
+	case sig := <-signals:
+		slog.Info("shutting down", "signal", sig.String(), "timeout", conf.ShutdownTimeout)
+	}
+	shutdown(servers, conf.ShutdownTimeout)
+	return 0
 }
 
-type sample struct {
-	Name  string `json:"name"`
-	File  string `json:"file"`
-	Input string `json:"input"`
+// adminOnly serves the requests to h which give conf.AdminToken as bearer
+// token, and refuses the others. Admin endpoints are disabled when there is
+// no token.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conf.AdminToken == "" {
+			apiError(w, http.StatusForbidden, fmt.Errorf("the admin endpoints are disabled, set admin-token to enable them"))
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dtc admin"`)
+			apiError(w, http.StatusUnauthorized, fmt.Errorf("invalid admin token"))
+			return
+		}
+		h(w, r)
+	}
 }
 
-type env struct {
-	ID      string   `json:"id,omitempty"`
-	Name    string   `json:"name"`
-	Mode    string   `json:"mode"`
-	File    string   `json:"file"`
-	Samples []sample `json:"samples"`
-	path    string
+func command(args []string) int {
+	switch args[0] {
+	case "serve":
+		return serve(args[1:])
+	case "config":
+		return configCommand(args[1:])
+	case "envs":
+		return envsCommand(args[1:])
+	case "list":
+		return listCommand(args[1:])
+	case "run":
+		return runCommand(args[1:])
+	case "proxy":
+		return proxyCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command '%s'\n", args[0])
+	return 2
 }
 
-var envs = []env{}
-
-func parseEnvs() error {
-	root := "envs"
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if path == root {
-			return nil
-		}
-		if info.IsDir() {
-			data, err := ioutil.ReadFile(filepath.Join(path, "config.json"))
-			if err != nil {
-				return err
-			}
-			l := env{
-				ID:   filepath.Base(path),
-				path: path,
-			}
-			err = json.Unmarshal(data, &l)
-			if err != nil {
-				return err
-			}
-			if l.Mode == "" {
-				l.Mode = l.ID
-			}
-			envs = append(envs, l)
-		}
-		return filepath.SkipDir
-	})
-	sort.Slice(envs, func(i, j int) bool {
-		return envs[i].Name < envs[j].Name
-	})
-	return err
+// request is what to run: Code is written to the file of the env, and Files,
+// if any, next to it. Sample is the sample the code comes from, if any.
+type request struct {
+	Env     string
+	Version string
+	Sample  string
+	Code    string
+	Input   string
+	Files   []requestFile
 }
 
-type request struct {
-	Env   string
-	Code  string
-	Input string
+type requestFile struct {
+	Name    string
+	Content string
 }
 
+// protocolV2 is the websocket subprotocol in which the server sends events
+// as JSON, with their sequence numbers, instead of base64 encoded text. It
+// starts with a "run" message giving the run ID, which lets clients attach
+// again to the run after a disconnection by sending {"attach": <id>,
+// "seq": <last seq received>} instead of a request.
+const protocolV2 = "dtc.v2"
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{protocolV2},
+}
+
+type runMessage struct {
+	request
+	Attach string
+	Seq    int
+}
+
+type attachedMessage struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Seq  int    `json:"seq"`
 }
 
 func runHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		fmt.Println(err)
+		slog.Warn("cannot upgrade to websocket", "err", err)
 		return
 	}
 	defer conn.Close()
 	_, data, err := conn.ReadMessage()
 	if err != nil {
-		fmt.Println(err)
+		slog.Warn("cannot read the websocket request", "err", err)
 		return
 	}
-	req := request{}
-	err = json.Unmarshal(data, &req)
+	msg := runMessage{}
+	err = json.Unmarshal(data, &msg)
 	if err != nil {
-		fmt.Println(err)
+		slog.Warn("invalid websocket request", "err", err)
 		return
 	}
-	err = runCode(req, conn)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-}
-
-func findEnv(ID string) (env, error) {
-	for _, l := range envs {
-		if l.ID == ID {
-			return l, nil
+	v2 := conn.Subprotocol() == protocolV2
+	send := func(e event) error {
+		if v2 {
+			return conn.WriteJSON(e)
 		}
+		return sendEvent(conn, e)
 	}
-	return env{}, fmt.Errorf("invalid env '%s'", ID)
-}
-
-func runCode(req request, conn *websocket.Conn) error {
-	env, err := findEnv(req.Env)
-	if err != nil {
-		return err
-	}
-	dir, err := ioutil.TempDir("/tmp/dtc", "dtc-"+req.Env+"-")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(dir)
-	err = ioutil.WriteFile(filepath.Join(dir, env.File), []byte(req.Code), 0666)
-	if err != nil {
-		return err
-	}
-	cmd := exec.Command("docker", "run", "--rm", "-i",
-		"-v", "/var/run/docker.sock:/var/run/docker.sock",
-		"-v", dir+":/dtc", "dtc-"+req.Env)
-	outp, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	errp, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-	if req.Input != "" {
-		inp, err := cmd.StdinPipe()
-		if err != nil {
-			return err
-		}
-		b, err := base64.StdEncoding.DecodeString(req.Input)
-		if err != nil {
-			return err
-		}
-		_, err = inp.Write(b)
-		if err != nil {
-			fmt.Println(err)
+	var attached *run
+	seq := 0
+	if msg.Attach != "" {
+		found, ok := runs.get(msg.Attach)
+		if !ok {
+			send(event{Type: eventError, Message: fmt.Sprintf("invalid run '%s', it may be over for too long", msg.Attach)})
+			return
 		}
-		inp.Close()
+		attached, seq = found, msg.Seq
+	} else {
+		attached = runs.start(msg.request)
 	}
-	send := make(chan []byte)
-	wg := sync.WaitGroup{}
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		if err := stream(send, outp); err != nil {
-			fmt.Println(err)
+	if v2 {
+		if err := conn.WriteJSON(attachedMessage{Type: "run", ID: attached.ID, Seq: seq}); err != nil {
+			slog.Warn("cannot send on websocket", "run", attached.ID, "err", err)
+			return
 		}
-	}()
+	}
+	// Keep reading so that control frames are handled and a client going away
+	// is noticed; the run itself goes on for it to attach again.
+	gone := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		if err := stream(send, errp); err != nil {
-			fmt.Println(err)
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
 		}
 	}()
-	go flush(send, conn)
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-	err = cmd.Wait()
-	wg.Wait()
-	close(send)
-	return err
-}
-
-func stream(send chan<- []byte, r io.Reader) error {
 	for {
-		buf := make([]byte, 1024)
-		n, err := r.Read(buf)
-		if err == io.EOF {
-			return nil
+		events, done, update := attached.follow(seq)
+		for _, e := range events {
+			seq = e.Seq
+			if err := send(e); err != nil {
+				slog.Warn("cannot send on websocket", "run", attached.ID, "err", err)
+				return
+			}
+		}
+		if done {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
 		}
-		if err != nil {
-			return err
+		select {
+		case <-update:
+		case <-gone:
+			return
 		}
-		send <- buf[:n]
 	}
 }
 
-func flush(send <-chan []byte, conn *websocket.Conn) {
-	for {
-		select {
-		case buf, ok := <-send:
-			if !ok {
-				return
-			}
-			w, err := conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-			defer w.Close()
-			_, err = fmt.Fprint(w, base64.StdEncoding.EncodeToString(buf))
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
+// eventMessage turns an event into what the front end expects: base64
+// encoded text to append to the output. Events it does not show are skipped.
+func eventMessage(e event) (string, bool) {
+	var text []byte
+	switch e.Type {
+	case eventStdout, eventStderr:
+		text = e.text()
+	case eventInfo, eventImage, eventLint:
+		text = []byte("\n" + e.Message + "\n")
+	case eventEgress:
+		if !e.Egress.blocked() {
+			return "", false
 		}
+		text = []byte("\n" + e.Message + "\n")
+	case eventError:
+		text = []byte("Error: " + e.Message + "\n")
+	default:
+		return "", false
 	}
+	return base64.StdEncoding.EncodeToString(text), true
 }
 
-func dataHandler(w http.ResponseWriter, r *http.Request) {
-	l, err := findEnv(r.FormValue("env"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-		return
+func sendEvent(conn *websocket.Conn, e event) error {
+	msg, ok := eventMessage(e)
+	if !ok {
+		return nil
 	}
-	file := filepath.Join(l.path, r.FormValue("file"))
-	content, err := ioutil.ReadFile(file)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-		return
+	return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+func findEnv(ID string) (env, error) {
+	for _, l := range envs {
+		if l.ID == ID {
+			return l, nil
+		}
 	}
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, err)
-		return
+	return env{}, fmt.Errorf("invalid env '%s'", ID)
+}
+
+type versionStatus struct {
+	version
+	Available bool   `json:"available"`
+	Status    string `json:"status"`
+}
+
+type envStatus struct {
+	env
+	Versions  []versionStatus `json:"versions"`
+	Available bool            `json:"available"`
+	Status    string          `json:"status"`
+}
+
+// envStatuses lists the envs along with whether their images are ready.
+func envStatuses() []envStatus {
+	list := make([]envStatus, len(envs))
+	for i, l := range envs {
+		list[i] = envStatus{env: l}
+		for _, v := range l.versions() {
+			vs := versionStatus{version: v, Status: imagePending}
+			if img, ok := images.get(l.ID, v.ID); ok {
+				vs.Status = img.status().Status
+				vs.Available = vs.Status == imageReady
+			}
+			if v.Default {
+				list[i].Available = vs.Available
+				list[i].Status = vs.Status
+			}
+			list[i].Versions = append(list[i].Versions, vs)
+		}
 	}
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, base64.StdEncoding.EncodeToString(content))
+	return list
 }
 
 func envsHandler(w http.ResponseWriter, r *http.Request) {
-	buf, err := json.Marshal(envs)
+	buf, err := json.Marshal(envStatuses())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprint(w, err)
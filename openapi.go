@@ -0,0 +1,232 @@
+package main
+
+// openAPI describes the REST API served under /api/v1.
+const openAPI = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Docker Teaches Code",
+    "version": "1.0.0",
+    "description": "Run code in the envs of a Docker Teaches Code server."
+  },
+  "paths": {
+    "/api/v1/runs": {
+      "post": {
+        "summary": "Start a run",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": { "$ref": "#/components/schemas/RunRequest" }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The finished run, when wait is true",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Run" } } }
+          },
+          "201": {
+            "description": "The started run",
+            "headers": { "Location": { "schema": { "type": "string" } } },
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Run" } } }
+          },
+          "400": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/api/v1/runs/{id}": {
+      "get": {
+        "summary": "Get the status and output of a run",
+        "parameters": [ { "$ref": "#/components/parameters/RunID" } ],
+        "responses": {
+          "200": {
+            "description": "The run",
+            "content": { "application/json": { "schema": { "$ref": "#/components/schemas/Run" } } }
+          },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/api/v1/runs/{id}/events": {
+      "get": {
+        "summary": "Stream the events of a run until it is over",
+        "parameters": [
+          { "$ref": "#/components/parameters/RunID" },
+          {
+            "name": "from",
+            "in": "query",
+            "description": "Only send the events after this sequence number",
+            "schema": { "type": "integer", "minimum": 0 }
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "One JSON event per line",
+            "content": { "application/x-ndjson": { "schema": { "$ref": "#/components/schemas/Event" } } }
+          },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/api/v1/lint": {
+      "post": {
+        "summary": "Lint code, without running it",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "required": [ "env", "code" ],
+                "properties": {
+                  "env": { "type": "string" },
+                  "code": { "type": "string" }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "The diagnostics of the code, none if the env has no linter",
+            "content": {
+              "application/json": {
+                "schema": { "type": "array", "items": { "$ref": "#/components/schemas/Diagnostic" } }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "RunID": { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+    },
+    "responses": {
+      "Error": {
+        "description": "What went wrong",
+        "content": {
+          "application/json": {
+            "schema": { "type": "object", "properties": { "error": { "type": "string" } } }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "RunRequest": {
+        "type": "object",
+        "required": [ "env", "code" ],
+        "properties": {
+          "env": { "type": "string", "description": "ID of the env, as listed by /envs/" },
+          "version": { "type": "string", "description": "Version of the env, its default one if empty" },
+          "sample": { "type": "string", "description": "Sample the code comes from, whose recorded network answers the run gets" },
+          "code": { "type": "string" },
+          "input": { "type": "string", "format": "byte", "description": "Standard input, base64 encoded" },
+          "files": {
+            "type": "array",
+            "description": "Extra files written next to the code",
+            "items": {
+              "type": "object",
+              "properties": { "name": { "type": "string" }, "content": { "type": "string" } }
+            }
+          },
+          "wait": { "type": "boolean", "description": "Only answer once the run is over" }
+        }
+      },
+      "Run": {
+        "type": "object",
+        "properties": {
+          "id": { "type": "string" },
+          "env": { "type": "string" },
+          "version": { "type": "string" },
+          "status": { "type": "string", "enum": [ "pending", "running", "done", "failed" ] },
+          "exitCode": { "type": "integer" },
+          "timedOut": { "type": "boolean", "description": "Whether the run was killed for taking too long" },
+          "cancelled": { "type": "boolean", "description": "Whether the run was cancelled" },
+          "truncated": { "type": "boolean", "description": "Whether the run was killed for writing more output than its limit" },
+          "cached": { "type": "boolean", "description": "Whether the run replayed the result of an identical run" },
+          "error": { "type": "string", "description": "Why the code could not be run, when failed" },
+          "created": { "type": "string", "format": "date-time" },
+          "started": { "type": "string", "format": "date-time" },
+          "finished": { "type": "string", "format": "date-time" },
+          "durationMs": { "type": "integer" },
+          "stdout": { "type": "string" },
+          "stderr": { "type": "string" }
+        }
+      },
+      "Diagnostic": {
+        "type": "object",
+        "properties": {
+          "line": { "type": "integer" },
+          "endLine": { "type": "integer" },
+          "severity": { "type": "string", "enum": [ "error", "warning", "info" ] },
+          "rule": { "type": "string" },
+          "message": { "type": "string" },
+          "explanation": { "type": "string" },
+          "lesson": { "type": "string", "description": "Name of the sample of the env teaching the rule" },
+          "link": { "type": "string", "description": "Fragment of the editor URL opening the sample, #<env>/<sample>" }
+        }
+      },
+      "BuildStep": {
+        "type": "object",
+        "properties": {
+          "stage": { "type": "string" },
+          "step": { "type": "integer" },
+          "steps": { "type": "integer" },
+          "instruction": { "type": "string" },
+          "status": { "type": "string", "enum": [ "running", "cached", "done", "error" ] },
+          "durationMs": { "type": "integer" },
+          "error": { "type": "string" }
+        }
+      },
+      "Image": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string" },
+          "size": { "type": "integer" },
+          "layers": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "id": { "type": "string" },
+                "size": { "type": "integer" },
+                "createdBy": { "type": "string" }
+              }
+            }
+          }
+        }
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "seq": { "type": "integer" },
+          "type": { "type": "string", "enum": [ "stdout", "stderr", "info", "error", "exit", "build", "image", "lint", "egress" ] },
+          "data": { "type": "string", "format": "byte", "description": "Output, base64 encoded" },
+          "service": { "type": "string", "description": "Service of a Compose env which logged the output" },
+          "message": { "type": "string" },
+          "exitCode": { "type": "integer" },
+          "build": { "$ref": "#/components/schemas/BuildStep" },
+          "image": { "$ref": "#/components/schemas/Image" },
+          "diagnostics": { "type": "array", "items": { "$ref": "#/components/schemas/Diagnostic" } },
+          "egress": {
+            "type": "object",
+            "description": "What the egress proxy of the run did with a request",
+            "properties": {
+              "action": { "type": "string", "enum": [ "denied", "allowed", "replayed", "missing", "recorded", "failed" ] },
+              "method": { "type": "string" },
+              "url": { "type": "string" },
+              "status": { "type": "integer" },
+              "error": { "type": "string" }
+            }
+          },
+          "time": { "type": "string", "format": "date-time" }
+        }
+      }
+    }
+  }
+}
+`
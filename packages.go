@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// packagesMount is where runs find the package cache of their env.
+const packagesMount = "/opt/dtc/packages"
+
+// packages lets the runs of an env install third-party packages with no
+// access to the network: the server seeds a cache with the packages of
+// Allow and their dependencies, using the image of the env, and mounts it
+// read-only in the runs, along with variables making Manager install from
+// it only. The code declares what it needs in the dependency file of
+// Manager, sent along with the code or given by the sample.
+type packages struct {
+	Manager string   `json:"manager"`
+	Allow   []string `json:"allow"`
+}
+
+// usesPackages tells whether the runs of v get the package cache of l.
+func (l env) usesPackages(v version) bool {
+	return l.Packages != nil && (v.Packages == nil || *v.Packages)
+}
+
+func (p packages) validate() map[string]string {
+	problems := map[string]string{}
+	if _, ok := packageManagers[p.Manager]; !ok {
+		problems["manager"] = fmt.Sprintf("'%s' is neither pip nor go", p.Manager)
+	}
+	if len(p.Allow) == 0 {
+		problems["allow"] = "must list at least one package"
+	}
+	for i, a := range p.Allow {
+		if strings.TrimSpace(a) == "" || strings.HasPrefix(a, "-") {
+			problems[fmt.Sprintf("allow[%d]", i)] = fmt.Sprintf("'%s' is not a package", a)
+		}
+	}
+	return problems
+}
+
+// packageManager is how the packages of a language are seeded and installed.
+type packageManager struct {
+	// File is the dependency file of the code.
+	File string
+	// Shared caches serve every version of an env, and are seeded with the
+	// default one, since the packages do not depend on the version.
+	Shared bool
+	// Seed is the command filling the cache mounted at packagesMount with
+	// the allowed packages, given as its arguments, with the variables
+	// SeedVars.
+	Seed     []string
+	SeedVars map[string]string
+	// Vars make runs install from the cache, and only from it.
+	Vars map[string]string
+}
+
+var packageManagers = map[string]packageManager{
+	"pip": {
+		File: "requirements.txt",
+		// pip wheel builds the packages only published as sources too, which
+		// could not be built with no index to get their build dependencies.
+		Seed: []string{"pip", "wheel", "--wheel-dir", packagesMount},
+		Vars: map[string]string{
+			"PIP_NO_INDEX":                  "1",
+			"PIP_FIND_LINKS":                packagesMount,
+			"PIP_DISABLE_PIP_VERSION_CHECK": "1",
+			"PIP_ROOT_USER_ACTION":          "ignore",
+		},
+	},
+	"go": {
+		File:   "go.mod",
+		Shared: true,
+		Seed:   []string{"sh", "-c", `cd "$(mktemp -d)" && go mod init dtc.local/seed && go get "$@"`, "seed"},
+		SeedVars: map[string]string{
+			"GOMODCACHE":  packagesMount,
+			"GOFLAGS":     "-modcacherw",
+			"GOTOOLCHAIN": "local",
+		},
+		// The download directory of a module cache is a module proxy. The
+		// modules are extracted to the module cache of the run, out of /dtc
+		// which holds go.mod and thus cannot be GOPATH.
+		Vars: map[string]string{
+			"GOPROXY":     "file://" + packagesMount + "/cache/download",
+			"GOSUMDB":     "off",
+			"GOFLAGS":     "-mod=mod",
+			"GOTOOLCHAIN": "local",
+			"GOPATH":      "/go",
+		},
+	},
+}
+
+// Statuses of the package caches.
+const (
+	packagesPending = "pending"
+	packagesSeeding = "seeding"
+	packagesReady   = "ready"
+	packagesFailed  = "failed"
+)
+
+// packageCache is the package cache of an env version, or of every version
+// of an env if its manager shares them.
+type packageCache struct {
+	packages
+	// name prefixes the directory of the cache, followed by a hash of what
+	// it is seeded with.
+	name string
+	// image is the image seeding the cache, one of the images of users.
+	image *image
+	users []*image
+	mu    sync.Mutex
+	// dir is the directory of the cache once seeded.
+	dir    string
+	status string
+	err    error
+}
+
+// newPackageCaches returns the package caches of l, whose images by version
+// are imgs, none if its runs install no packages. The images get the caches
+// of their runs.
+func newPackageCaches(l env, imgs map[string]*image) []*packageCache {
+	if l.Packages == nil {
+		return nil
+	}
+	caches := []*packageCache{}
+	if packageManagers[l.Packages.Manager].Shared {
+		def, _ := l.findVersion("")
+		cache := &packageCache{packages: *l.Packages, name: l.ID, image: imgs[def.ID]}
+		for _, v := range l.versions() {
+			if l.usesPackages(v) {
+				cache.users = append(cache.users, imgs[v.ID])
+			}
+		}
+		caches = append(caches, cache)
+	} else {
+		for _, v := range l.versions() {
+			if !l.usesPackages(v) {
+				continue
+			}
+			name := l.ID
+			if v.ID != "" {
+				name += "-" + v.ID
+			}
+			caches = append(caches, &packageCache{packages: *l.Packages, name: name, image: imgs[v.ID], users: []*image{imgs[v.ID]}})
+		}
+	}
+	for _, cache := range caches {
+		cache.setStatus(packagesPending, "", nil)
+		for _, img := range cache.users {
+			img.packages = cache
+		}
+	}
+	return caches
+}
+
+func (c *packageCache) setStatus(status, dir string, err error) {
+	c.mu.Lock()
+	c.status, c.dir, c.err = status, dir, err
+	c.mu.Unlock()
+	for _, img := range c.users {
+		img.mu.Lock()
+		img.Packages = status
+		img.notify()
+		img.mu.Unlock()
+	}
+}
+
+// ready returns the directory of the cache, or why it cannot be used.
+func (c *packageCache) ready() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.status {
+	case packagesReady:
+		return c.dir, nil
+	case packagesFailed:
+		return "", fmt.Errorf("could not be seeded: %v", c.err)
+	}
+	return "", fmt.Errorf("is still being seeded")
+}
+
+// seededFile marks the caches whose seeding completed.
+const seededFile = ".seeded"
+
+// seed fills the cache, unless it already was with the same packages and
+// image, and removes the caches seeded before. What it does is appended to
+// the build log of the image.
+func (c *packageCache) seed() error {
+	manager := packageManagers[c.Manager]
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", c.Manager, c.image.status().Hash)
+	for _, a := range c.Allow {
+		fmt.Fprintf(h, "%s\x00", a)
+	}
+	dir := filepath.Join(conf.PackagesDir, c.name+"-"+hex.EncodeToString(h.Sum(nil))[:12])
+	if _, err := os.Stat(filepath.Join(dir, seededFile)); err == nil {
+		c.setStatus(packagesReady, dir, nil)
+		return nil
+	}
+	c.setStatus(packagesSeeding, "", nil)
+	slog.Info("seeding the package cache", "dir", dir, "image", c.image.Name, "packages", strings.Join(c.Allow, " "))
+	fmt.Fprintf(c.image, "Seeding %s with %s\n", dir, strings.Join(c.Allow, " "))
+	err := os.RemoveAll(dir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		args := []string{"run", "--rm", "-v", dir + ":" + packagesMount}
+		args = append(args, labelArgs("", time.Now())...)
+		for _, k := range sortedKeys(manager.SeedVars) {
+			args = append(args, "-e", k+"="+manager.SeedVars[k])
+		}
+		args = append(args, c.image.Name)
+		args = append(args, manager.Seed...)
+		cmd := exec.Command(conf.Docker, append(args, c.Allow...)...)
+		cmd.Stdout = c.image
+		cmd.Stderr = c.image
+		err = cmd.Run()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, seededFile), nil, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(c.image, "Cannot seed %s: %v\n", dir, err)
+		c.setStatus(packagesFailed, "", err)
+		return err
+	}
+	c.setStatus(packagesReady, dir, nil)
+	removeStale(conf.PackagesDir, c.name, dir)
+	return nil
+}
+
+// removeStale removes the caches of parent named after name, followed by the
+// hash of what they hold, but for the current one in dir.
+func removeStale(parent, name, dir string) {
+	infos, err := ioutil.ReadDir(parent)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(parent, info.Name())
+		if path == dir || len(info.Name()) != len(name)+13 || !strings.HasPrefix(info.Name(), name+"-") {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("cannot remove a stale cache", "dir", path, "err", err)
+		}
+	}
+}
+
+// packageArgs returns the docker run flags giving a run of l the package
+// cache of its version, and writes the dependency file of s to dir unless
+// the code came with one.
+func packageArgs(l env, v version, s *sample, dir string, r *run) ([]string, error) {
+	manager := packageManagers[l.Packages.Manager]
+	if s != nil && s.Dependencies != "" {
+		path := filepath.Join(dir, manager.File)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			data, err := ioutil.ReadFile(filepath.Join(l.path, s.Dependencies))
+			if err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(path, data, 0666); err != nil {
+				return nil, err
+			}
+		}
+	}
+	args, err := packageMounts(l, v)
+	if err != nil {
+		r.emit(event{Type: eventInfo, Message: fmt.Sprintf("Packages: the package cache of this env %v, no package can be installed", err)})
+		return nil, nil
+	}
+	return args, nil
+}
+
+// packageMounts returns the docker run flags giving the package cache of v
+// to a container, or why it cannot be used.
+func packageMounts(l env, v version) ([]string, error) {
+	manager := packageManagers[l.Packages.Manager]
+	img, ok := images.get(l.ID, v.ID)
+	if !ok || img.packages == nil {
+		return nil, fmt.Errorf("is missing")
+	}
+	cacheDir, err := img.packages.ready()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-v", cacheDir + ":" + packagesMount + ":ro"}
+	for _, k := range sortedKeys(manager.Vars) {
+		args = append(args, "-e", k+"="+manager.Vars[k])
+	}
+	return args, nil
+}
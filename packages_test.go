@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewPackageCachesVersions(t *testing.T) {
+	off := false
+	versions := []version{{ID: "1.10", Packages: &off}, {ID: "1.21", Default: true}, {ID: "1.22"}}
+	tests := []struct {
+		manager string
+		caches  []string
+	}{
+		{"go", []string{"golang: 1.21 1.21 1.22"}},
+		{"pip", []string{"golang-1.21: 1.21 1.21", "golang-1.22: 1.22 1.22"}},
+	}
+	for _, test := range tests {
+		l := env{ID: "golang", Versions: versions, Packages: &packages{Manager: test.manager, Allow: []string{"a"}}}
+		imgs := map[string]*image{}
+		for _, v := range versions {
+			imgs[v.ID] = &image{imageStatus: imageStatus{Version: v.ID}, update: make(chan struct{})}
+		}
+		caches := []string{}
+		for _, c := range newPackageCaches(l, imgs) {
+			desc := c.name + ": " + c.image.Version
+			for _, img := range c.users {
+				desc += " " + img.Version
+			}
+			caches = append(caches, desc)
+		}
+		if !reflect.DeepEqual(caches, test.caches) {
+			t.Errorf("%s: caches = %q, want %q", test.manager, caches, test.caches)
+		}
+		if imgs["1.10"].packages != nil {
+			t.Errorf("%s: the 1.10 image got a package cache", test.manager)
+		}
+	}
+}
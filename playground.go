@@ -0,0 +1,112 @@
+package main
+
+import (
+	"go/format"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// playgroundEnv is the env the Go playground compatible endpoints run code in.
+const playgroundEnv = "golang"
+
+type playgroundEvent struct {
+	Message string
+	Kind    string
+	Delay   time.Duration
+}
+
+type compileResponse struct {
+	Errors      string
+	Events      []playgroundEvent
+	Status      int
+	IsTest      bool
+	TestsFailed int
+	VetErrors   string `json:",omitempty"`
+}
+
+type fmtResponse struct {
+	Body  string
+	Error string
+}
+
+// compileHandler implements the /compile endpoint of the Go playground: the
+// code in the body form value is run in the Go env and its output returned as
+// events, each with the delay since the previous one.
+func compileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := request{Env: playgroundEnv, Code: r.FormValue("body")}
+	if err := req.check(); err != nil {
+		writeJSON(w, http.StatusOK, compileResponse{Errors: err.Error()})
+		return
+	}
+	run := runs.start(req)
+	if !run.wait(r.Context().Done()) {
+		return
+	}
+	events, _, _ := run.follow(0)
+	status := run.status()
+	if status.ExitCode == nil {
+		writeJSON(w, http.StatusOK, compileResponse{Errors: status.Error})
+		return
+	}
+	resp := compileResponse{Status: *status.ExitCode}
+	stdout, stderr := run.output()
+	// go run reports build failures on stderr under the name of the package,
+	// with exit status 1 and nothing written on stdout.
+	if resp.Status != 0 && len(stdout) == 0 && strings.HasPrefix(string(stderr), "# command-line-arguments") {
+		resp.Errors = playgroundPaths(string(stderr))
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	last := status.Created
+	if status.Started != nil {
+		last = *status.Started
+	}
+	for _, e := range events {
+		if e.Type != eventStdout && e.Type != eventStderr {
+			continue
+		}
+		resp.Events = append(resp.Events, playgroundEvent{
+			Message: string(e.text()),
+			Kind:    e.Type,
+			Delay:   e.Time.Sub(last),
+		})
+		last = e.Time
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// fmtHandler implements the /fmt endpoint of the Go playground with gofmt.
+// Fixing imports is not supported, so the imports form value is ignored.
+func fmtHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	out, err := format.Source([]byte(r.FormValue("body")))
+	if err != nil {
+		writeJSON(w, http.StatusOK, fmtResponse{Error: "prog.go:" + err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, fmtResponse{Body: string(out)})
+}
+
+// playgroundCode renames the file of the code, which Go reports relative to
+// /dtc, the working directory of runs, or in full.
+var playgroundCode = strings.NewReplacer("/dtc/main.go", "./prog.go", "./main.go", "./prog.go")
+
+// playgroundPaths names the code the way the playground does in messages.
+func playgroundPaths(msg string) string {
+	msg = playgroundCode.Replace(msg)
+	return strings.TrimPrefix(msg, "# command-line-arguments\n")
+}
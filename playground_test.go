@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestPlaygroundPaths(t *testing.T) {
+	tests := []struct {
+		name, stderr, want string
+	}{
+		{
+			"relative",
+			"# command-line-arguments\n./main.go:6:2: undefined: x\n./main.go:7:14: cannot use \"a\" (untyped string constant) as int value in assignment\n",
+			"./prog.go:6:2: undefined: x\n./prog.go:7:14: cannot use \"a\" (untyped string constant) as int value in assignment\n",
+		},
+		{
+			"absolute",
+			"# command-line-arguments\n/dtc/main.go:6:2: undefined: x\n",
+			"./prog.go:6:2: undefined: x\n",
+		},
+		{
+			"other package",
+			"# example.com/lib\n/go/pkg/mod/example.com/lib/lib.go:3:1: syntax error\n",
+			"# example.com/lib\n/go/pkg/mod/example.com/lib/lib.go:3:1: syntax error\n",
+		},
+	}
+	for _, test := range tests {
+		if got := playgroundPaths(test.stderr); got != test.want {
+			t.Errorf("%s: playgroundPaths() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
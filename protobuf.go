@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The gRPC messages are few and small, so they are encoded and decoded by
+// hand in the protobuf wire format rather than with generated code.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type pbWriter struct {
+	buf []byte
+}
+
+func (w *pbWriter) tag(field, wire int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field<<3|wire))
+}
+
+// varint writes v even when it is zero, for optional and oneof fields.
+func (w *pbWriter) varint(field int, v int64) {
+	w.tag(field, wireVarint)
+	w.buf = binary.AppendUvarint(w.buf, uint64(v))
+}
+
+func (w *pbWriter) int(field int, v int64) {
+	if v != 0 {
+		w.varint(field, v)
+	}
+}
+
+func (w *pbWriter) bool(field int, b bool) {
+	if b {
+		w.varint(field, 1)
+	}
+}
+
+// bytes writes b even when it is empty, for oneof fields.
+func (w *pbWriter) bytes(field int, b []byte) {
+	w.tag(field, wireBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *pbWriter) string(field int, s string) {
+	if s != "" {
+		w.bytes(field, []byte(s))
+	}
+}
+
+func (w *pbWriter) message(field int, m *pbWriter) {
+	w.bytes(field, m.buf)
+}
+
+// pbField is a decoded field: Varint holds the value of varint fields, Bytes
+// that of length delimited ones. Fixed size fields are skipped.
+type pbField struct {
+	Num    int
+	Wire   int
+	Varint uint64
+	Bytes  []byte
+}
+
+func pbFields(buf []byte) ([]pbField, error) {
+	fields := []pbField{}
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid field key")
+		}
+		buf = buf[n:]
+		f := pbField{Num: int(key >> 3), Wire: int(key & 7)}
+		switch f.Wire {
+		case wireVarint:
+			f.Varint, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint in field %d", f.Num)
+			}
+			buf = buf[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || size > uint64(len(buf)-n) {
+				return nil, fmt.Errorf("invalid length of field %d", f.Num)
+			}
+			f.Bytes = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if f.Wire == wireFixed32 {
+				size = 4
+			}
+			if len(buf) < size {
+				return nil, fmt.Errorf("invalid field %d", f.Num)
+			}
+			buf = buf[size:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", f.Wire, f.Num)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
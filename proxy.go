@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of the egress proxy: requests are refused, answered from the
+// fixtures of the sample, sent to the network and added to the fixtures, or
+// let through to the allowed hosts only.
+const (
+	egressDeny   = "deny"
+	egressReplay = "replay"
+	egressRecord = "record"
+	egressAllow  = "allow"
+)
+
+// Actions of the egress proxy, reported for every request.
+const (
+	egressListening = "listening"
+	egressDenied    = "denied"
+	egressAllowed   = "allowed"
+	egressReplayed  = "replayed"
+	egressMissing   = "missing"
+	egressRecorded  = "recorded"
+	egressFailed    = "failed"
+)
+
+// Files of the directory of the egress proxy.
+const (
+	fixturesFile = "fixtures.json"
+	caCertFile   = "ca.crt"
+	caKeyFile    = "ca.key"
+)
+
+// fixture is an HTTP exchange recorded for a sample, replayed in place of the
+// network.
+type fixture struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+}
+
+// egressEvent is what the egress proxy did with a request. The proxy prints
+// them as lines of JSON.
+type egressEvent struct {
+	Action string `json:"action"`
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// blocked tells whether the request did not get the answer it would have got
+// from the network.
+func (e egressEvent) blocked() bool {
+	return e.Action == egressDenied || e.Action == egressMissing || e.Action == egressFailed
+}
+
+// message explains e to users, allow being the hosts the run may reach if
+// only some.
+func (e egressEvent) message(allow []string) string {
+	switch e.Action {
+	case egressDenied:
+		if len(allow) > 0 {
+			return fmt.Sprintf("Network: %s %s was blocked, this run may only reach %s", e.Method, e.URL, strings.Join(allow, ", "))
+		}
+		return fmt.Sprintf("Network: %s %s was blocked, this run has no access to the network", e.Method, e.URL)
+	case egressAllowed:
+		return fmt.Sprintf("Network: %s %s was let through", e.Method, e.URL)
+	case egressMissing:
+		return fmt.Sprintf("Network: %s %s was blocked, it is not in the recorded answers of the sample", e.Method, e.URL)
+	case egressFailed:
+		return fmt.Sprintf("Network: %s %s failed: %s", e.Method, e.URL, e.Error)
+	case egressReplayed:
+		return fmt.Sprintf("Network: %s %s was answered from the recording", e.Method, e.URL)
+	case egressRecorded:
+		return fmt.Sprintf("Network: %s %s was recorded", e.Method, e.URL)
+	}
+	return "Network: " + e.Action
+}
+
+// egressProxy is the HTTP proxy standing between a run and the network. It
+// intercepts HTTPS too, with certificates of a certificate authority the run
+// trusts.
+type egressProxy struct {
+	mode      string
+	allow     []string
+	dir       string
+	ca        tls.Certificate
+	key       crypto.Signer
+	transport *http.Transport
+
+	mu       sync.Mutex
+	fixtures []fixture
+	// replayed counts the answers given for each request, so that repeated
+	// requests get the answers recorded in turn.
+	replayed map[string]int
+	certs    map[string]*tls.Certificate
+	out      *json.Encoder
+}
+
+func newEgressProxy(mode string, allow []string, dir string, out io.Writer) (*egressProxy, error) {
+	if mode != egressDeny && mode != egressReplay && mode != egressRecord && mode != egressAllow {
+		return nil, fmt.Errorf("'%s' is not one of deny, replay, record or allow", mode)
+	}
+	ca, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	p := &egressProxy{mode: mode, allow: allow, dir: dir, ca: ca, key: key,
+		transport: &http.Transport{Proxy: nil, TLSHandshakeTimeout: 10 * time.Second},
+		fixtures:  []fixture{}, replayed: map[string]int{}, certs: map[string]*tls.Certificate{},
+		out: json.NewEncoder(out)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, fixturesFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &p.fixtures); err != nil {
+			return nil, fmt.Errorf("%s: %v", fixturesFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *egressProxy) log(e egressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.out.Encode(e)
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		p.connect(w, req)
+		return
+	}
+	if !req.URL.IsAbs() {
+		http.Error(w, "this is the egress proxy of the run, it only serves proxy requests", http.StatusBadRequest)
+		return
+	}
+	resp := p.respond(req)
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// connect intercepts the HTTPS requests of a CONNECT tunnel.
+func (p *egressProxy) connect(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if p.mode == egressAllow {
+		p.tunnel(w, req)
+		return
+	}
+	if p.mode == egressDeny {
+		p.log(egressEvent{Action: egressDenied, Method: req.Method, URL: "https://" + strings.TrimSuffix(host, ":443")})
+		http.Error(w, "this run has no access to the network", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot intercept the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	tlsConn := tls.Server(conn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.certificate(name)
+		},
+	})
+	rd := bufio.NewReader(tlsConn)
+	for {
+		in, err := http.ReadRequest(rd)
+		if err != nil {
+			return
+		}
+		in.URL.Scheme = "https"
+		in.URL.Host = strings.TrimSuffix(host, ":443")
+		resp := p.respond(in)
+		io.Copy(ioutil.Discard, in.Body)
+		err = resp.Write(tlsConn)
+		resp.Body.Close()
+		if err != nil || in.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// tunnel connects a CONNECT tunnel to its host, if it is allowed, without
+// intercepting what goes through.
+func (p *egressProxy) tunnel(w http.ResponseWriter, req *http.Request) {
+	name, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		name, port = req.Host, "443"
+	}
+	e := egressEvent{Method: req.Method, URL: "https://" + strings.TrimSuffix(req.Host, ":443")}
+	if !p.allowed(name, port) {
+		e.Action = egressDenied
+		p.log(e)
+		http.Error(w, fmt.Sprintf("this run may not reach %s", req.Host), http.StatusForbidden)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", net.JoinHostPort(name, port), 10*time.Second)
+	if err != nil {
+		e.Action, e.Error = egressFailed, err.Error()
+		p.log(e)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot tunnel the connection", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	e.Action = egressAllowed
+	p.log(e)
+	go func() {
+		io.Copy(upstream, buf)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(conn, upstream)
+}
+
+// allowed tells whether host may be reached on port. Entries of the
+// allowlist are host names, or *. followed by a domain for all the hosts in
+// it, and end with :port to only allow that port.
+func (p *egressProxy) allowed(host, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range p.allow {
+		name := strings.ToLower(a)
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			if name[i+1:] != port {
+				continue
+			}
+			name = name[:i]
+		}
+		if name == host || (strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// respond answers req according to the mode of the proxy.
+func (p *egressProxy) respond(req *http.Request) *http.Response {
+	e := egressEvent{Method: req.Method, URL: req.URL.String()}
+	answer := func(status int, header http.Header, body []byte) *http.Response {
+		if header == nil {
+			header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		}
+		header = header.Clone()
+		header.Del("Transfer-Encoding")
+		header.Set("Content-Length", fmt.Sprint(len(body)))
+		e.Status = status
+		p.log(e)
+		return &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: header,
+			ContentLength: int64(len(body)), Body: ioutil.NopCloser(bytes.NewReader(body))}
+	}
+	switch p.mode {
+	case egressDeny:
+		e.Action = egressDenied
+		return answer(http.StatusForbidden, nil, []byte("this run has no access to the network\n"))
+	case egressReplay:
+		if f := p.replay(req.Method, e.URL); f != nil {
+			e.Action = egressReplayed
+			return answer(f.Status, f.Header, f.Body)
+		}
+		e.Action = egressMissing
+		return answer(http.StatusBadGateway, nil, []byte(fmt.Sprintf("no answer to %s %s was recorded for this sample\n", req.Method, e.URL)))
+	case egressAllow:
+		port := req.URL.Port()
+		if port == "" {
+			port = "80"
+			if req.URL.Scheme == "https" {
+				port = "443"
+			}
+		}
+		if !p.allowed(req.URL.Hostname(), port) {
+			e.Action = egressDenied
+			return answer(http.StatusForbidden, nil, []byte(fmt.Sprintf("this run may not reach %s\n", req.URL.Host)))
+		}
+	}
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := p.transport.RoundTrip(out)
+	var body []byte
+	if err == nil {
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		e.Action, e.Error = egressFailed, err.Error()
+		return answer(http.StatusBadGateway, nil, []byte(err.Error()+"\n"))
+	}
+	if p.mode == egressAllow {
+		e.Action = egressAllowed
+		return answer(resp.StatusCode, resp.Header, body)
+	}
+	f := fixture{Method: req.Method, URL: e.URL, Status: resp.StatusCode, Header: resp.Header, Body: body}
+	if err := p.record(f); err != nil {
+		e.Action, e.Error = egressFailed, err.Error()
+	} else {
+		e.Action = egressRecorded
+	}
+	return answer(f.Status, f.Header, f.Body)
+}
+
+// replay returns the next recorded answer to method url, the last one once
+// they were all given, and nil if there is none.
+func (p *egressProxy) replay(method, url string) *fixture {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := method + " " + url
+	matches := []*fixture{}
+	for i := range p.fixtures {
+		if p.fixtures[i].Method == method && p.fixtures[i].URL == url {
+			matches = append(matches, &p.fixtures[i])
+		}
+	}
+	if len(matches) == 0 {
+		return nil
+	}
+	n := p.replayed[key]
+	p.replayed[key]++
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+	return matches[n]
+}
+
+// record adds f to the fixtures, and saves them.
+func (p *egressProxy) record(f fixture) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fixtures = append(p.fixtures, f)
+	data, err := json.MarshalIndent(p.fixtures, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(p.dir, fixturesFile)
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// certificate returns a certificate for host signed by the certificate
+// authority of the run.
+func (p *egressProxy) certificate(host string) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cert, ok := p.certs[host]; ok {
+		return cert, nil
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     p.ca.Leaf.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca.Leaf, p.key.Public(), p.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, p.ca.Certificate[0]}, PrivateKey: p.key}
+	p.certs[host] = cert
+	return cert, nil
+}
+
+// newCA writes to dir a certificate authority for the egress proxy of a
+// run, valid for validity.
+func newCA(dir string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Docker Teaches Code egress proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, caCertFile), cert, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, caKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+// proxyCommand runs the egress proxy of a run, in a container next to it. It
+// prints what it does with every request as lines of JSON.
+func proxyCommand(args []string) int {
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := flags.String("listen", ":3128", "address of the proxy")
+	mode := flags.String("mode", egressDeny, "deny, replay, record or allow")
+	allow := flags.String("allow", "", "comma separated hosts the allow mode lets through, each a name, *.domain, and optionally :port")
+	dir := flags.String("dir", "/egress", "directory of the certificate authority and of "+fixturesFile)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	hosts := []string{}
+	if *allow != "" {
+		hosts = strings.Split(*allow, ",")
+	}
+	p, err := newEgressProxy(*mode, hosts, *dir, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	p.log(egressEvent{Action: egressListening})
+	fmt.Fprintln(os.Stderr, http.Serve(l, p))
+	return 1
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Labels of the containers and images the server creates, so that those left
+// behind by a crash can be found.
+const (
+	runLabel      = "dtc.run"
+	instanceLabel = "dtc.instance"
+	createdLabel  = "dtc.created"
+)
+
+// instanceID tells this server apart from the others sharing the Docker
+// daemon, and from its previous lives.
+var instanceID = newID()
+
+// maxReports is how many reaper reports are kept.
+const maxReports = 20
+
+// labelArgs returns the flags labelling a container or image created for the
+// run runID, which is empty for the env images.
+func labelArgs(runID string, created time.Time) []string {
+	args := []string{"--label", instanceLabel + "=" + instanceID,
+		"--label", createdLabel + "=" + created.UTC().Format(time.RFC3339)}
+	if runID != "" {
+		args = append(args, "--label", runLabel+"="+runID)
+	}
+	return args
+}
+
+// reapReport is what one pass of the reaper removed.
+type reapReport struct {
+	Time       time.Time `json:"time"`
+	Containers []string  `json:"containers"`
+	Images     []string  `json:"images"`
+	Networks   []string  `json:"networks"`
+	Volumes    []string  `json:"volumes"`
+	Workdirs   []string  `json:"workdirs"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// leftoverReaper removes what runs leave behind when the server does not
+// clean up after them: containers, images, networks and volumes labelled with
+// a run, and workspaces. Only those older than conf.ReaperAge go, and never those of
+// the runs of this server still in progress.
+type leftoverReaper struct {
+	// reaping is held during a pass, so that passes do not overlap.
+	reaping sync.Mutex
+	mu      sync.Mutex
+	reports []reapReport
+}
+
+var reaper = &leftoverReaper{}
+
+// start reaps now, then every interval if it is not zero.
+func (rp *leftoverReaper) start(interval time.Duration) {
+	go func() {
+		rp.reap()
+		if interval <= 0 {
+			return
+		}
+		for range time.Tick(interval) {
+			rp.reap()
+		}
+	}()
+}
+
+func (rp *leftoverReaper) reap() reapReport {
+	rp.reaping.Lock()
+	defer rp.reaping.Unlock()
+	report := reapReport{Time: time.Now(), Containers: []string{}, Images: []string{}, Networks: []string{}, Volumes: []string{}, Workdirs: []string{}}
+	fail := func(err error) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	ids, err := labelled("container", "ls", "-a", "-q", "--filter", "label="+runLabel)
+	if err != nil {
+		fail(err)
+	}
+	for _, id := range ids {
+		name, err := reapable("container", id)
+		if err != nil {
+			fail(err)
+		} else if name != "" {
+			if err := docker("container", "rm", "-f", id); err != nil {
+				fail(err)
+			} else {
+				report.Containers = append(report.Containers, name)
+			}
+		}
+	}
+	ids, err = labelled("image", "ls", "-q", "--no-trunc", "--filter", "label="+runLabel)
+	if err != nil {
+		fail(err)
+	}
+	for _, id := range uniq(ids) {
+		name, err := reapable("image", id)
+		if err != nil {
+			fail(err)
+		} else if name != "" {
+			if err := docker("image", "rm", "-f", id); err != nil {
+				fail(err)
+			} else {
+				report.Images = append(report.Images, name)
+			}
+		}
+	}
+	ids, err = labelled("network", "ls", "-q", "--filter", "label="+runLabel)
+	if err != nil {
+		fail(err)
+	}
+	for _, id := range ids {
+		name, err := reapable("network", id)
+		if err != nil {
+			fail(err)
+		} else if name != "" {
+			if err := docker("network", "rm", id); err != nil {
+				fail(err)
+			} else {
+				report.Networks = append(report.Networks, name)
+			}
+		}
+	}
+	ids, err = labelled("volume", "ls", "-q", "--filter", "label="+runLabel)
+	if err != nil {
+		fail(err)
+	}
+	for _, id := range ids {
+		name, err := reapable("volume", id)
+		if err != nil {
+			fail(err)
+		} else if name != "" {
+			if err := docker("volume", "rm", "-f", id); err != nil {
+				fail(err)
+			} else {
+				report.Volumes = append(report.Volumes, name)
+			}
+		}
+	}
+	active := map[string]bool{}
+	for _, r := range runs.list() {
+		r.mu.Lock()
+		if r.Status != runDone && r.Status != runFailed && r.workdir != "" {
+			active[r.workdir] = true
+		}
+		r.mu.Unlock()
+	}
+	infos, err := ioutil.ReadDir(conf.Workdir)
+	if err != nil {
+		fail(err)
+	}
+	for _, info := range infos {
+		path := filepath.Join(conf.Workdir, info.Name())
+		if !strings.HasPrefix(info.Name(), "dtc-") || active[path] || time.Since(info.ModTime()) < conf.ReaperAge {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			fail(err)
+		} else {
+			report.Workdirs = append(report.Workdirs, path)
+		}
+	}
+	if len(report.Containers)+len(report.Images)+len(report.Networks)+len(report.Volumes)+len(report.Workdirs)+len(report.Errors) > 0 {
+		slog.Info("reaped leftovers", "containers", len(report.Containers), "images", len(report.Images),
+			"networks", len(report.Networks), "volumes", len(report.Volumes), "workdirs", len(report.Workdirs), "errors", len(report.Errors))
+	}
+	rp.mu.Lock()
+	rp.reports = append([]reapReport{report}, rp.reports...)
+	if len(rp.reports) > maxReports {
+		rp.reports = rp.reports[:maxReports]
+	}
+	rp.mu.Unlock()
+	return report
+}
+
+// labelled lists the IDs docker prints for args.
+func labelled(args ...string) ([]string, error) {
+	out, err := exec.Command(conf.Docker, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker %s: %v", args[0], err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// reapable returns the name of the container, image, network or volume id if it
+// should be removed, and an empty string otherwise.
+func reapable(kind, id string) (string, error) {
+	name, labels := "{{ .Name }}", ".Config.Labels"
+	switch kind {
+	case "image":
+		name = "{{ join .RepoTags \",\" }}"
+	case "network", "volume":
+		labels = ".Labels"
+	}
+	format := fmt.Sprintf("%s\t{{ index %s %q }}\t{{ index %s %q }}\t{{ index %s %q }}",
+		name, labels, runLabel, labels, instanceLabel, labels, createdLabel)
+	out, err := exec.Command(conf.Docker, kind, "inspect", "--format", format, id).Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s inspect %s: %v", kind, id, err)
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), "\t")
+	if len(fields) != 4 {
+		return "", fmt.Errorf("docker %s inspect %s: unexpected output %q", kind, id, out)
+	}
+	if fields[2] == instanceID {
+		if r, ok := runs.get(fields[1]); ok && !r.over() {
+			return "", nil
+		}
+	}
+	created, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil || time.Since(created) < conf.ReaperAge {
+		return "", nil
+	}
+	name = strings.TrimPrefix(fields[0], "/")
+	if name == "" || name == "<none>:<none>" {
+		name = id
+	}
+	return name, nil
+}
+
+func docker(args ...string) error {
+	out, err := exec.Command(conf.Docker, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func uniq(list []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// reaperHandler serves /admin/reaper: GET returns the latest reports, most
+// recent first, and POST reaps right away and returns what was removed.
+func reaperHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		writeJSON(w, http.StatusOK, reaper.reap())
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	reaper.mu.Lock()
+	reports := append([]reapReport{}, reaper.reports...)
+	reaper.mu.Unlock()
+	writeJSON(w, http.StatusOK, reports)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// result is what a run of a cacheable env wrote, and when, for the identical
+// runs after it to replay.
+type result struct {
+	Key      string
+	Env      string
+	Events   []resultEvent
+	ExitCode int
+	Duration time.Duration
+	size     int64
+}
+
+// resultEvent is an event of a result, Offset after the start of the run,
+// negative for the events before it like lint ones. Exit and error events
+// are not kept: the run replaying the result emits its own.
+type resultEvent struct {
+	Offset time.Duration
+	event
+}
+
+// resultStats are the counters of the result cache, as served by
+// /admin/results.
+type resultStats struct {
+	Entries   int                    `json:"entries"`
+	Size      int64                  `json:"size"`
+	MaxSize   int64                  `json:"maxSize"`
+	Hits      int                    `json:"hits"`
+	Misses    int                    `json:"misses"`
+	Evictions int                    `json:"evictions"`
+	Envs      map[string]*resultStat `json:"envs"`
+}
+
+type resultStat struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	Hits    int   `json:"hits"`
+	Misses  int   `json:"misses"`
+}
+
+// resultCache keeps the results of the runs of cacheable envs, by the hash of
+// everything that could change them, up to conf.ResultsSize bytes of output.
+// The least recently used results go first.
+type resultCache struct {
+	mu      sync.Mutex
+	results map[string]*list.Element
+	// order has the most recently used results first.
+	order     *list.List
+	size      int64
+	evictions int
+	hits      map[string]int
+	misses    map[string]int
+}
+
+var results = &resultCache{
+	results: map[string]*list.Element{},
+	order:   list.New(),
+	hits:    map[string]int{},
+	misses:  map[string]int{},
+}
+
+// get returns the result of key, counting a hit for env. Misses are counted
+// when the result of the run is stored, since the runs whose result is not
+// could not have been replayed anyway.
+func (c *resultCache) get(env, key string) (*result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.results[key]
+	if !ok {
+		return nil, false
+	}
+	c.hits[env]++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*result), true
+}
+
+// store keeps res, making room for it, and counts the miss of its run.
+func (c *resultCache) store(res *result) {
+	max := sizeBytes(conf.ResultsSize)
+	for _, e := range res.Events {
+		res.size += int64(len(e.Data) + len(e.Message))
+	}
+	if res.size > max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.misses[res.Env]++
+	if elem, ok := c.results[res.Key]; ok {
+		c.remove(elem)
+	}
+	for c.size+res.size > max {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	c.results[res.Key] = c.order.PushFront(res)
+	c.size += res.size
+}
+
+// remove forgets the result of elem. Callers must hold c.mu.
+func (c *resultCache) remove(elem *list.Element) {
+	res := c.order.Remove(elem).(*result)
+	delete(c.results, res.Key)
+	c.size -= res.size
+}
+
+// purge forgets the results of env, or all of them if env is empty, and
+// returns how many.
+func (c *resultCache) purge(env string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		if env == "" || elem.Value.(*result).Env == env {
+			c.remove(elem)
+			n++
+		}
+		elem = next
+	}
+	return n
+}
+
+func (c *resultCache) stats() resultStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := resultStats{Entries: c.order.Len(), Size: c.size, MaxSize: sizeBytes(conf.ResultsSize),
+		Evictions: c.evictions, Envs: map[string]*resultStat{}}
+	stat := func(env string) *resultStat {
+		if stats.Envs[env] == nil {
+			stats.Envs[env] = &resultStat{}
+		}
+		return stats.Envs[env]
+	}
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		res := elem.Value.(*result)
+		stat(res.Env).Entries++
+		stat(res.Env).Size += res.size
+	}
+	for env, n := range c.hits {
+		stat(env).Hits = n
+		stats.Hits += n
+	}
+	for env, n := range c.misses {
+		stat(env).Misses = n
+		stats.Misses += n
+	}
+	return stats
+}
+
+// resultKey returns the hash of everything the result of req depends on in
+// env, or false if it cannot be cached: the image, the files and input of
+// the run, its limits, its network, and the packages it can install. Only
+// the runs with no network are cached, since what they get from it may
+// change.
+func resultKey(env env, req request) (string, bool) {
+	if !env.Cacheable || sizeBytes(conf.ResultsSize) == 0 {
+		return "", false
+	}
+	v, err := env.findVersion(req.Version)
+	if err != nil {
+		return "", false
+	}
+	var s *sample
+	if req.Sample != "" {
+		found, err := env.findSample(req.Sample)
+		if err != nil {
+			return "", false
+		}
+		s = &found
+	}
+	mode, _ := egressMode(env, s, req)
+	if mode != egressDeny {
+		return "", false
+	}
+	img, ok := images.get(env.ID, v.ID)
+	if !ok || img.status().ID == "" {
+		return "", false
+	}
+	file, vars := env.File, map[string]string{}
+	if env.Entrypoint != nil {
+		if file, vars, err = env.Entrypoint.detect(req.Code); err != nil {
+			return "", false
+		}
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "image=%s\x00env=%s\x00version=%s\x00", img.status().ID, env.ID, v.ID)
+	lim := env.Limits.or(conf.Limits)
+	fmt.Fprintf(h, "limits=%s,%s,%d,%s,%s\x00", lim.Memory, lim.CPUs, lim.PIDs, lim.Timeout, lim.Output)
+	fmt.Fprintf(h, "egress=%s\x00", mode)
+	if s != nil && s.unchanged(env, req) {
+		fmt.Fprintf(h, "sample=%s,%s\x00", s.ID, s.Egress)
+		if s.Network != nil {
+			fmt.Fprintf(h, "network=%s,%s\x00", s.Network.Policy, strings.Join(s.Network.Allow, ","))
+		}
+	}
+	for _, k := range sortedKeys(vars) {
+		fmt.Fprintf(h, "var=%s=%s\x00", k, vars[k])
+	}
+	files := map[string]string{file: req.Code}
+	for _, f := range req.Files {
+		if _, ok := files[filepath.Clean(f.Name)]; !ok {
+			files[filepath.Clean(f.Name)] = f.Content
+		}
+	}
+	if env.usesPackages(v) {
+		if s != nil {
+			name := packageManagers[env.Packages.Manager].File
+			if _, ok := files[name]; !ok && s.Dependencies != "" {
+				data, err := ioutil.ReadFile(filepath.Join(env.path, s.Dependencies))
+				if err != nil {
+					return "", false
+				}
+				files[name] = string(data)
+			}
+		}
+		dir := ""
+		if img.packages != nil {
+			dir, _ = img.packages.ready()
+		}
+		fmt.Fprintf(h, "packages=%s\x00", dir)
+	}
+	for _, name := range sortedKeys(files) {
+		fmt.Fprintf(h, "file=%s\x00%d\x00%s", name, len(files[name]), files[name])
+	}
+	fmt.Fprintf(h, "input=%d\x00%s", len(input), input)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// runCached runs req, or replays the result of an identical run of it if
+// its env is cacheable, and keeps the result for the next ones. Runs whose
+// standard input is streamed cannot be replayed.
+func runCached(req request, r *run) (*int, error) {
+	env, err := findEnv(req.Env)
+	if err != nil || r.stdin != nil {
+		return runCode(req, r)
+	}
+	key, ok := resultKey(env, req)
+	if !ok {
+		return runCode(req, r)
+	}
+	if res, ok := results.get(env.ID, key); ok {
+		slog.Debug("replaying the result of an identical run", "run", r.ID, "result", key)
+		return res.replay(r)
+	}
+	code, err := runCode(req, r)
+	status := r.status()
+	if err != nil || code == nil || status.TimedOut || status.Cancelled || status.Truncated || status.Started == nil {
+		return code, err
+	}
+	res := &result{Key: key, Env: env.ID, ExitCode: *code, Duration: time.Since(*status.Started)}
+	r.mu.Lock()
+	for _, e := range r.events {
+		if e.Type != eventExit && e.Type != eventError {
+			res.Events = append(res.Events, resultEvent{Offset: e.Time.Sub(*status.Started), event: e})
+		}
+	}
+	r.mu.Unlock()
+	results.store(res)
+	return code, err
+}
+
+// replay emits the events of res to r as they were emitted the first time.
+func (res *result) replay(r *run) (*int, error) {
+	r.mu.Lock()
+	r.Cached = true
+	r.mu.Unlock()
+	events := res.Events
+	for len(events) > 0 && events[0].Offset < 0 {
+		r.emit(events[0].event)
+		events = events[1:]
+	}
+	r.setRunning()
+	started := *r.status().Started
+	wait := func(offset time.Duration) bool {
+		timer := time.NewTimer(time.Until(started.Add(offset)))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-r.cancelled:
+			return false
+		}
+	}
+	for _, e := range events {
+		if !wait(e.Offset) {
+			return nil, fmt.Errorf("the run was cancelled")
+		}
+		r.emit(e.event)
+	}
+	if !wait(res.Duration) {
+		return nil, fmt.Errorf("the run was cancelled")
+	}
+	code := res.ExitCode
+	return &code, nil
+}
+
+// resultsHandler serves /admin/results: GET returns the statistics of the
+// result cache, and DELETE empties it, or only of the results of the env
+// given as ?env=, and returns how many results were removed.
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		env := r.URL.Query().Get("env")
+		n := results.purge(env)
+		slog.Info("purged the result cache", "env", env, "results", n)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		apiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, results.stats())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultKey(t *testing.T) {
+	dir, _ := testEnvDir(t, map[string]string{"hello.py": "print(1)\n"})
+	defer func(size string) { conf.ResultsSize = size }(conf.ResultsSize)
+	conf.ResultsSize = "64m"
+	images.mu.Lock()
+	images.images[imageKey("python", "")] = &image{imageStatus: imageStatus{ID: "sha256:1"}}
+	images.mu.Unlock()
+	defer func() {
+		images.mu.Lock()
+		delete(images.images, imageKey("python", ""))
+		images.mu.Unlock()
+	}()
+	none, allow := &networkPolicy{Policy: networkNone}, &networkPolicy{Policy: networkAllowlist, Allow: []string{"pypi.org"}}
+	base := env{ID: "python", File: "main.py", Network: none, Cacheable: true, Samples: []sample{{ID: "hello", File: "hello.py"}}, path: dir}
+	with := func(change func(l *env)) env {
+		l := base
+		l.Samples = append([]sample{}, base.Samples...)
+		change(&l)
+		return l
+	}
+	hello := request{Env: "python", Code: "print(1)\n", Sample: "hello"}
+	edited := request{Env: "python", Code: "print(2)\n", Sample: "hello"}
+	key := func(l env, req request) string {
+		k, ok := resultKey(l, req)
+		if !ok {
+			return ""
+		}
+		return k
+	}
+	if key(base, hello) == "" || key(base, edited) == "" {
+		t.Fatalf("the runs of a cacheable env with no network have no key")
+	}
+	if key(base, hello) != key(base, hello) {
+		t.Errorf("identical runs have different keys")
+	}
+	if a, b := key(base, request{Env: "python", Code: "print(1)\n", Files: []requestFile{{Name: "a.py"}, {Name: "b.py"}}}),
+		key(base, request{Env: "python", Code: "print(1)\n", Files: []requestFile{{Name: "b.py"}, {Name: "./a.py"}}}); a != b {
+		t.Errorf("runs with the same files in another order have different keys")
+	}
+	uncached := []struct {
+		name string
+		env  env
+		req  request
+	}{
+		{"not cacheable", with(func(l *env) { l.Cacheable = false }), hello},
+		{"no network policy", with(func(l *env) { l.Network = nil }), hello},
+		{"allowlist", with(func(l *env) { l.Network = allow }), hello},
+		{"replay", with(func(l *env) { l.Network, l.Egress = nil, egressReplay }), hello},
+		{"sample allowlist", with(func(l *env) { l.Samples[0].Network = allow }), hello},
+		{"sample replay", with(func(l *env) { l.Network, l.Egress, l.Samples[0].Egress = nil, egressDeny, egressReplay }), hello},
+		{"invalid version", base, request{Env: "python", Code: "print(1)\n", Version: "2"}},
+		{"invalid input", base, request{Env: "python", Code: "print(1)\n", Input: "%"}},
+	}
+	for _, test := range uncached {
+		if k := key(test.env, test.req); k != "" {
+			t.Errorf("%s: the run has a key", test.name)
+		}
+	}
+	// Both deny every request through the same proxy.
+	if key(with(func(l *env) { l.Network, l.Egress = nil, egressDeny }), hello) != key(base, hello) {
+		t.Errorf("the runs of an env with deny egress and of one with no network have different keys")
+	}
+	if key(with(func(l *env) { l.Samples[0].Network = allow }), edited) == "" {
+		t.Errorf("edited code of a sample with network has no key")
+	}
+	conf.ResultsSize = "0"
+	if key(base, hello) != "" {
+		t.Errorf("a run has a key with no result cache")
+	}
+	conf.ResultsSize = "64m"
+	changed := []struct {
+		name string
+		env  env
+		req  request
+	}{
+		{"edited", base, edited},
+		{"input", base, request{Env: "python", Code: "print(1)\n", Sample: "hello", Input: "aGkK"}},
+		{"file", base, request{Env: "python", Code: "print(1)\n", Files: []requestFile{{Name: "a.py"}}}},
+		{"sample egress", with(func(l *env) { l.Network, l.Egress, l.Samples[0].Egress = nil, egressReplay, egressDeny }), hello},
+		{"sample network", with(func(l *env) { l.Samples[0].Network = none }), hello},
+		{"memory", with(func(l *env) { l.Limits.Memory = "64m" }), hello},
+		{"timeout", with(func(l *env) { l.Limits.Timeout = "5s" }), hello},
+		{"output", with(func(l *env) { l.Limits.Output = "1k" }), hello},
+	}
+	seen := map[string]string{key(base, hello): "base"}
+	for _, test := range changed {
+		k := key(test.env, test.req)
+		if k == "" {
+			t.Errorf("%s: the run has no key", test.name)
+		} else if other, ok := seen[k]; ok {
+			t.Errorf("%s: the run has the key of %s", test.name, other)
+		}
+		seen[k] = test.name
+	}
+}
+
+func TestResultCacheMisses(t *testing.T) {
+	defer func(size string) { conf.ResultsSize = size }(conf.ResultsSize)
+	conf.ResultsSize = "1k"
+	c := &resultCache{results: map[string]*list.Element{}, order: list.New(), hits: map[string]int{}, misses: map[string]int{}}
+	if _, ok := c.get("python", "a"); ok {
+		t.Fatal("an empty cache has a result")
+	}
+	if stats := c.stats(); stats.Misses != 0 {
+		t.Errorf("misses = %d after a lookup, want 0 until the result is stored", stats.Misses)
+	}
+	c.store(&result{Key: "a", Env: "python", Events: []resultEvent{{event: event{Type: eventStdout, Data: []byte("hi\n")}}}})
+	c.store(&result{Key: "b", Env: "python", Events: []resultEvent{{event: event{Type: eventStdout, Data: make([]byte, 2048)}}}})
+	if _, ok := c.get("python", "a"); !ok {
+		t.Fatal("the stored result is missing")
+	}
+	stats := c.stats()
+	if stats.Entries != 1 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("entries, hits, misses = %d, %d, %d, want 1, 1, 1", stats.Entries, stats.Hits, stats.Misses)
+	}
+}
+
+func TestResultReplay(t *testing.T) {
+	res := &result{
+		Events: []resultEvent{
+			{Offset: -time.Millisecond, event: event{Type: eventLint, Message: "Dockerfile:1: warning"}},
+			{Offset: 0, event: event{Type: eventStdout, Data: []byte("hi\n")}},
+			{Offset: time.Millisecond, event: event{Type: eventEgress, Message: "denied", Egress: &egressEvent{Action: egressDenied}}},
+			{Offset: 2 * time.Millisecond, event: event{Type: eventInfo, Message: "Packages: none"}},
+		},
+		ExitCode: 3,
+		Duration: 3 * time.Millisecond,
+	}
+	r := &run{update: make(chan struct{}), cancelled: make(chan struct{}), truncated: make(chan struct{})}
+	code, err := res.replay(r)
+	if err != nil || code == nil || *code != 3 {
+		t.Fatalf("replay() = %v, %v, want 3", code, err)
+	}
+	got := []string{}
+	for _, e := range r.events {
+		got = append(got, e.Type+" "+e.Message+string(e.Data))
+	}
+	want := []string{"lint Dockerfile:1: warning", "stdout hi\n", "egress denied", "info Packages: none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if status := r.status(); !status.Cached || status.Started == nil || r.events[0].Time.After(*status.Started) {
+		t.Errorf("the replayed run is not cached, or started before its lint events")
+	}
+}
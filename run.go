@@ -0,0 +1,656 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	runPending = "pending"
+	runRunning = "running"
+	runDone    = "done"
+	runFailed  = "failed"
+)
+
+const (
+	eventStdout = "stdout"
+	eventStderr = "stderr"
+	eventInfo   = "info"
+	eventError  = "error"
+	eventExit   = "exit"
+	eventBuild  = "build"
+	eventImage  = "image"
+	eventLint   = "lint"
+	eventEgress = "egress"
+)
+
+// runRetention is how long a finished run is kept around for clients to
+// fetch its result.
+const runRetention = 10 * time.Minute
+
+// event is one thing that happened during a run. Data holds the raw bytes of
+// the output events, Message the text of the others. Build events carry the
+// progress of a step of an image build, image events the image built, and
+// lint events the diagnostics of the code, and egress events what the egress
+// proxy did with a request. Output logged by a service of a
+// Compose env is tagged with its name.
+type event struct {
+	Seq         int          `json:"seq"`
+	Type        string       `json:"type"`
+	Data        []byte       `json:"data,omitempty"`
+	Service     string       `json:"service,omitempty"`
+	Message     string       `json:"message,omitempty"`
+	ExitCode    *int         `json:"exitCode,omitempty"`
+	Build       *buildStep   `json:"build,omitempty"`
+	Image       *imageInfo   `json:"image,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+	Egress      *egressEvent `json:"egress,omitempty"`
+	Time        time.Time    `json:"time"`
+}
+
+type runStatus struct {
+	ID        string `json:"id"`
+	Env       string `json:"env"`
+	Version   string `json:"version,omitempty"`
+	Status    string `json:"status"`
+	ExitCode  *int   `json:"exitCode,omitempty"`
+	TimedOut  bool   `json:"timedOut,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	// Truncated runs wrote more output than their limit and were killed.
+	Truncated bool `json:"truncated,omitempty"`
+	// Cached runs replay the result of an identical run.
+	Cached     bool       `json:"cached,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Created    time.Time  `json:"created"`
+	Started    *time.Time `json:"started,omitempty"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	DurationMs int64      `json:"durationMs,omitempty"`
+}
+
+// run is one execution of some code. Every event it produces is kept so that
+// any number of clients can follow it, from the start or from where they
+// left.
+type run struct {
+	runStatus
+	mu        sync.Mutex
+	events    []event
+	update    chan struct{}
+	cancelled chan struct{}
+	// outputLimit is how many bytes of output the run can write, with no
+	// limit if zero, and outputSize how many it did. truncated is closed
+	// once it wrote more, the rest being dropped.
+	outputLimit int64
+	outputSize  int64
+	truncated   chan struct{}
+	// stdin, if not nil, is read after the input of the request until it
+	// ends, for clients that stream the standard input.
+	stdin io.Reader
+	// workdir is the directory the files of the run are written to.
+	workdir string
+}
+
+func (r *run) status() runStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.runStatus
+}
+
+func (r *run) emit(e event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.Type == eventStdout || e.Type == eventStderr {
+		if r.Truncated {
+			return
+		}
+		if r.outputLimit > 0 && r.outputSize+int64(len(e.Data)) > r.outputLimit {
+			e.Data = e.Data[:r.outputLimit-r.outputSize]
+			if len(e.Data) > 0 {
+				r.appendEvent(e)
+			}
+			r.outputSize = r.outputLimit
+			r.Truncated = true
+			close(r.truncated)
+			r.appendEvent(event{Type: eventInfo, Message: fmt.Sprintf("Output truncated: the run wrote more than %d bytes and was killed", r.outputLimit)})
+			return
+		}
+		r.outputSize += int64(len(e.Data))
+	}
+	r.appendEvent(e)
+}
+
+// appendEvent records e and wakes up followers. Callers must hold r.mu.
+func (r *run) appendEvent(e event) {
+	e.Seq = len(r.events) + 1
+	e.Time = time.Now()
+	r.events = append(r.events, e)
+	close(r.update)
+	r.update = make(chan struct{})
+}
+
+// follow returns the events after seq, whether the run is over, and a channel
+// closed on the next event.
+func (r *run) follow(seq int) ([]event, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seq > len(r.events) {
+		seq = len(r.events)
+	}
+	done := r.Status == runDone || r.Status == runFailed
+	return r.events[seq:], done, r.update
+}
+
+// wait blocks until the run is over or cancel is closed.
+func (r *run) wait(cancel <-chan struct{}) bool {
+	for {
+		_, done, update := r.follow(0)
+		if done {
+			return true
+		}
+		select {
+		case <-update:
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// output returns everything the run wrote on its stdout and stderr so far.
+func (r *run) output() ([]byte, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stdout, stderr := []byte{}, []byte{}
+	for _, e := range r.events {
+		switch e.Type {
+		case eventStdout:
+			stdout = append(stdout, e.text()...)
+		case eventStderr:
+			stderr = append(stderr, e.text()...)
+		}
+	}
+	return stdout, stderr
+}
+
+// text is the output of an output event as shown to users, prefixed with the
+// service it comes from if any.
+func (e event) text() []byte {
+	if e.Service == "" {
+		return e.Data
+	}
+	return append([]byte(e.Service+" | "), e.Data...)
+}
+
+func (r *run) over() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Status == runDone || r.Status == runFailed
+}
+
+// info tells the clients of the run about msg, unless the run is over.
+func (r *run) info(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status != runDone && r.Status != runFailed {
+		r.appendEvent(event{Type: eventInfo, Message: msg})
+	}
+}
+
+// cancel asks for the run to be stopped. It returns false if the run is
+// already over.
+func (r *run) cancel() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status == runDone || r.Status == runFailed {
+		return false
+	}
+	if !r.Cancelled {
+		r.Cancelled = true
+		close(r.cancelled)
+	}
+	return true
+}
+
+// setRunning records the start of the run, unless it started already.
+func (r *run) setRunning() {
+	r.mu.Lock()
+	if r.Started != nil {
+		r.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	r.Status = runRunning
+	r.Started = &now
+	r.mu.Unlock()
+}
+
+// finish records the end of the run. A nil exitCode means the code could not
+// be run at all, and err says why.
+func (r *run) finish(exitCode *int, err error) {
+	r.mu.Lock()
+	now := time.Now()
+	r.Finished = &now
+	if r.Started != nil {
+		r.DurationMs = now.Sub(*r.Started).Nanoseconds() / int64(time.Millisecond)
+	}
+	r.ExitCode = exitCode
+	r.Status = runDone
+	if exitCode == nil {
+		r.Status = runFailed
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if exitCode == nil {
+		r.appendEvent(event{Type: eventError, Message: r.Error})
+	} else {
+		r.appendEvent(event{Type: eventExit, ExitCode: exitCode})
+	}
+	r.mu.Unlock()
+}
+
+type runManager struct {
+	mu   sync.Mutex
+	runs map[string]*run
+	// closing is set when the server shuts down, after which runs fail
+	// right away.
+	closing bool
+}
+
+var runs = &runManager{runs: map[string]*run{}}
+
+func (m *runManager) get(ID string) (*run, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.runs[ID]
+	return r, ok
+}
+
+// close makes every new run fail, and returns those not over yet.
+func (m *runManager) close() []*run {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+	active := []*run{}
+	for _, r := range m.list() {
+		if !r.over() {
+			active = append(active, r)
+		}
+	}
+	return active
+}
+
+func (m *runManager) list() []*run {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*run, 0, len(m.runs))
+	for _, r := range m.runs {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list
+}
+
+// start registers a new run for req and executes it in the background. The
+// run is forgotten runRetention after it is over.
+func (m *runManager) start(req request) *run {
+	return m.startStdin(req, nil)
+}
+
+// startStdin is start for a run whose standard input goes on with stdin.
+func (m *runManager) startStdin(req request, stdin io.Reader) *run {
+	r := &run{
+		runStatus: runStatus{
+			ID:      newID(),
+			Env:     req.Env,
+			Version: req.Version,
+			Status:  runPending,
+			Created: time.Now(),
+		},
+		update:    make(chan struct{}),
+		cancelled: make(chan struct{}),
+		truncated: make(chan struct{}),
+		stdin:     stdin,
+	}
+	m.mu.Lock()
+	m.runs[r.ID] = r
+	closing := m.closing
+	m.mu.Unlock()
+	go func() {
+		var exitCode *int
+		err := fmt.Errorf("the server is shutting down, try again in a moment")
+		if !closing {
+			slog.Debug("run started", "run", r.ID, "env", req.Env, "version", req.Version)
+			exitCode, err = runCached(req, r)
+		}
+		r.finish(exitCode, err)
+		if err != nil {
+			slog.Error("run failed", "run", r.ID, "err", err)
+		} else {
+			slog.Debug("run finished", "run", r.ID, "exitCode", *exitCode)
+		}
+		time.AfterFunc(runRetention, func() {
+			m.mu.Lock()
+			delete(m.runs, r.ID)
+			m.mu.Unlock()
+		})
+	}()
+	return r
+}
+
+// check reports the problems runCode would find with req before running it.
+func (req request) check() error {
+	l, err := findEnv(req.Env)
+	if err != nil {
+		return err
+	}
+	if _, err := l.findVersion(req.Version); err != nil {
+		return err
+	}
+	if l.Entrypoint != nil {
+		if _, _, err := l.Entrypoint.detect(req.Code); err != nil {
+			return err
+		}
+	}
+	if req.Sample != "" {
+		if _, err := l.findSample(req.Sample); err != nil {
+			return err
+		}
+	}
+	if _, err := base64.StdEncoding.DecodeString(req.Input); err != nil {
+		return fmt.Errorf("invalid input: %v", err)
+	}
+	return checkFiles(req.Files)
+}
+
+// checkFiles makes sure extra files stay inside the directory of the run.
+func checkFiles(files []requestFile) error {
+	for _, f := range files {
+		name := filepath.Clean(f.Name)
+		if f.Name == "" || filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid file name '%s'", f.Name)
+		}
+	}
+	return nil
+}
+
+// runCode runs req in a container of its env, streaming the output to r. It
+// returns the exit code of the code, or nil if it could not be run.
+func runCode(req request, r *run) (*int, error) {
+	env, err := findEnv(req.Env)
+	if err != nil {
+		return nil, err
+	}
+	version, err := env.findVersion(req.Version)
+	if err != nil {
+		return nil, err
+	}
+	if !envAvailable(env.ID, version.ID) {
+		return nil, fmt.Errorf("%s is not available yet, its image is still being prepared", version.Name)
+	}
+	file, vars := env.File, map[string]string{}
+	if env.Entrypoint != nil {
+		file, vars, err = env.Entrypoint.detect(req.Code)
+		if err != nil {
+			return nil, err
+		}
+	}
+	input, err := base64.StdEncoding.DecodeString(req.Input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %v", err)
+	}
+	if err := checkFiles(req.Files); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(conf.Workdir, "dtc-"+req.Env+"-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	r.mu.Lock()
+	r.workdir = dir
+	r.mu.Unlock()
+	for _, f := range req.Files {
+		path := filepath.Join(dir, filepath.Clean(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(f.Content), 0666); err != nil {
+			return nil, err
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, file), []byte(req.Code), 0666)
+	if err != nil {
+		return nil, err
+	}
+	if diags := lintCode(env, req.Code); len(diags) > 0 {
+		r.emit(event{Type: eventLint, Message: lintMessage(file, diags), Diagnostics: diags})
+	}
+	name := "dtc-run-" + r.ID
+	args := []string{"run", "--rm", "-i", "--name", name,
+		"-v", dir + ":/dtc", "-e", "DTC_FILE=" + file,
+		"-e", "DTC_RUN=" + r.ID, "-e", "DTC_INSTANCE=" + instanceID,
+		"-e", "DTC_CREATED=" + r.Created.UTC().Format(time.RFC3339)}
+	args = append(args, labelArgs(r.ID, r.Created)...)
+	for _, k := range sortedKeys(vars) {
+		args = append(args, "-e", k+"="+vars[k])
+	}
+	var s *sample
+	if req.Sample != "" {
+		found, err := env.findSample(req.Sample)
+		if err != nil {
+			return nil, err
+		}
+		s = &found
+	}
+	if env.usesPackages(version) {
+		packageArgs, err := packageArgs(env, version, s, dir, r)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, packageArgs...)
+	}
+	if len(env.Caches) > 0 {
+		cacheArgs, removeCaches, err := cacheArgs(env, version, r)
+		if err != nil {
+			return nil, err
+		}
+		defer removeCaches()
+		args = append(args, cacheArgs...)
+	}
+	mode, allow := egressMode(env, s, req)
+	if env.Daemon != nil || mode != "" {
+		network, removeNetwork, err := createNetwork(r, mode != "")
+		if err != nil {
+			return nil, err
+		}
+		defer removeNetwork()
+		args = append(args, "--network", network)
+		extra := []string{}
+		if mode != "" {
+			proxy, err := startEgress(env, s, mode, allow, r, network)
+			if err != nil {
+				return nil, err
+			}
+			defer proxy.stop()
+			extra = proxy.runArgs()
+			args = append(args, extra...)
+		}
+		if env.Daemon != nil {
+			daemonArgs, stop, err := startDaemon(*env.Daemon, env.Limits.or(conf.Limits), r, dir, network, extra)
+			if err != nil {
+				return nil, err
+			}
+			defer stop()
+			args = append(args, daemonArgs...)
+		}
+	}
+	lim := env.Limits.or(conf.Limits)
+	if lim.Output != "" {
+		r.mu.Lock()
+		r.outputLimit = sizeBytes(lim.Output)
+		r.mu.Unlock()
+	}
+	if env.Daemon != nil && env.Daemon.Build {
+		r.setRunning()
+		if code, err := buildRun(r, file, lim); code != nil || err != nil {
+			return code, err
+		}
+		args = append(args, "-e", "DTC_IMAGE="+runImage(r))
+	}
+	args = append(args, limitArgs(lim)...)
+	args = append(args, imageName(env, version))
+	compose := env.Daemon != nil && env.Daemon.Compose
+	if compose {
+		args = append(args, composeCommand(file)...)
+	}
+	cmd := exec.Command(conf.Docker, args...)
+	inp, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	errp, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-r.cancelled:
+		return nil, fmt.Errorf("the run was cancelled")
+	default:
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	r.setRunning()
+	// Errors writing the input only mean the code did not read all of it.
+	go func() {
+		defer inp.Close()
+		if _, err := inp.Write(input); err != nil {
+			return
+		}
+		if r.stdin != nil {
+			io.Copy(inp, r.stdin)
+		}
+	}()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		read := stream
+		if compose {
+			read = streamServices
+		}
+		if err := read(r, eventStdout, outp); err != nil {
+			slog.Error("cannot read the output", "run", r.ID, "err", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := stream(r, eventStderr, errp); err != nil {
+			slog.Error("cannot read the output", "run", r.ID, "err", err)
+		}
+	}()
+	timedOut := make(chan struct{})
+	if timeout := lim.timeout(); timeout > 0 {
+		r.mu.Lock()
+		timeout -= time.Since(*r.Started)
+		r.mu.Unlock()
+		timer := time.AfterFunc(timeout, func() {
+			close(timedOut)
+			if err := exec.Command(conf.Docker, "kill", name).Run(); err != nil {
+				slog.Error("cannot kill the container", "run", r.ID, "err", err)
+			}
+		})
+		defer timer.Stop()
+	}
+	over := make(chan struct{})
+	go func() {
+		select {
+		case <-r.cancelled:
+		case <-r.truncated:
+		case <-over:
+			return
+		}
+		if err := exec.Command(conf.Docker, "kill", name).Run(); err != nil {
+			slog.Error("cannot kill the container", "run", r.ID, "err", err)
+		}
+	}()
+	wg.Wait()
+	err = cmd.Wait()
+	close(over)
+	select {
+	case <-timedOut:
+		r.mu.Lock()
+		r.TimedOut = true
+		r.mu.Unlock()
+		r.emit(event{Type: eventInfo, Message: fmt.Sprintf("Killed: the run took more than %s", lim.Timeout)})
+	case <-r.cancelled:
+		r.emit(event{Type: eventInfo, Message: "Killed: the run was cancelled"})
+	default:
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		code := exit.ExitCode()
+		return &code, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	code := 0
+	return &code, nil
+}
+
+func limitArgs(lim limits) []string {
+	args := []string{}
+	if lim.Memory != "" {
+		args = append(args, "--memory", lim.Memory)
+	}
+	if lim.CPUs != "" {
+		args = append(args, "--cpus", lim.CPUs)
+	}
+	if lim.PIDs > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(lim.PIDs))
+	}
+	return args
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+func stream(r *run, typ string, rd io.Reader) error {
+	for {
+		buf := make([]byte, 1024)
+		n, err := rd.Read(buf)
+		if n > 0 {
+			r.emit(event{Type: typ, Data: buf[:n]})
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCheckFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"util.py", true},
+		{"src/util.py", true},
+		{"./util.py", true},
+		{"src/../util.py", true},
+		{"..util.py", true},
+		{"src/..util", true},
+		{"", false},
+		{".", false},
+		{"./", false},
+		{"src/..", false},
+		{"..", false},
+		{"../util.py", false},
+		{"src/../../util.py", false},
+		{"/etc/passwd", false},
+		{"/dtc/util.py", false},
+	}
+	for _, test := range tests {
+		err := checkFiles([]requestFile{{Name: "main.py"}, {Name: test.name}})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("checkFiles(%q) = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestRequestCheck(t *testing.T) {
+	dir, _ := testEnvDir(t, map[string]string{"hello.py": "print(1)\n"})
+	defer func(saved []env) { envs = saved }(envs)
+	envs = []env{
+		{ID: "python", path: dir, Versions: []version{{ID: "3.12", Default: true}, {ID: "3.11"}}, Samples: []sample{{ID: "hello", File: "hello.py"}}},
+		{ID: "java", path: dir, Entrypoint: &entrypoint{Pattern: `public class (\w+)`, File: "$1.java", Error: "a Java program needs a public class"}},
+	}
+	tests := []struct {
+		name string
+		req  request
+		err  string
+	}{
+		{"valid", request{Env: "python", Code: "print(1)\n"}, ""},
+		{"version", request{Env: "python", Version: "3.11", Sample: "hello", Input: "aGkK", Files: []requestFile{{Name: "util.py"}}}, ""},
+		{"entrypoint", request{Env: "java", Code: "public class Main {}"}, ""},
+		{"unknown env", request{Env: "ruby"}, "invalid env 'ruby'"},
+		{"unknown version", request{Env: "python", Version: "2.7"}, "invalid version '2.7' for env 'python'"},
+		{"no entrypoint", request{Env: "java", Code: "class Main {}"}, "a Java program needs a public class"},
+		{"unknown sample", request{Env: "python", Sample: "bye"}, "invalid sample 'bye' for env 'python'"},
+		{"invalid input", request{Env: "python", Input: "not base64!"}, "invalid input: illegal base64 data at input byte 3"},
+		{"file outside", request{Env: "python", Files: []requestFile{{Name: "../../etc/cron.d/x"}}}, "invalid file name '../../etc/cron.d/x'"},
+	}
+	for _, test := range tests {
+		if got := errString(test.req.check()); got != test.err {
+			t.Errorf("%s: check() = %q, want %q", test.name, got, test.err)
+		}
+	}
+}
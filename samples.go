@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// dataHandler serves the files declared by the samples of an env:
+// /data/<env>/<sample> for the code and /data/<env>/<sample>/input for the
+// input. Nothing else in the env directory can be reached.
+func dataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/data"), "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "input") {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("expected /data/<env>/<sample>[/input]"))
+		return
+	}
+	l, err := findEnv(parts[0])
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	s, err := l.findSample(parts[1])
+	if err != nil {
+		httpError(w, http.StatusNotFound, err)
+		return
+	}
+	name := s.File
+	if len(parts) == 3 {
+		if s.Input == "" {
+			httpError(w, http.StatusNotFound, fmt.Errorf("sample '%s' has no input", s.ID))
+			return
+		}
+		name = s.Input
+	}
+	path := filepath.Join(l.path, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		httpError(w, http.StatusNotFound, fmt.Errorf("file of sample '%s' is missing", s.ID))
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	sum := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	if utf8.Valid(content) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(content))
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprint(w, err)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDataHandler(t *testing.T) {
+	dir, _ := testEnvDir(t, map[string]string{
+		"hello.py":    "print('hi')\n",
+		"echo.py":     "print(input())\n",
+		"echo.txt":    "hi\n",
+		"config.json": "{}",
+		"Dockerfile":  "FROM python:3.12\n",
+		"logo.bin":    "\xff\xfe",
+	})
+	defer func(saved []env) { envs = saved }(envs)
+	envs = []env{{ID: "python", path: dir, Samples: []sample{
+		{ID: "hello", File: "hello.py"},
+		{ID: "echo", File: "echo.py", Input: "echo.txt"},
+		{ID: "logo", File: "logo.bin"},
+		{ID: "gone", File: "gone.py"},
+	}}}
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/data/python/hello", http.StatusOK, "print('hi')\n"},
+		{"HEAD", "/data/python/hello", http.StatusOK, ""},
+		{"GET", "/data/python/echo/input", http.StatusOK, "hi\n"},
+		{"GET", "/data/python/echo/", http.StatusOK, "print(input())\n"},
+		{"GET", "/data/python/hello/input", http.StatusNotFound, "sample 'hello' has no input"},
+		{"GET", "/data/python/echo/output", http.StatusBadRequest, "expected /data/<env>/<sample>[/input]"},
+		{"GET", "/data/python", http.StatusBadRequest, "expected /data/<env>/<sample>[/input]"},
+		{"GET", "/data/python/hello.py", http.StatusNotFound, "invalid sample 'hello.py' for env 'python'"},
+		{"GET", "/data/python/config.json", http.StatusNotFound, "invalid sample 'config.json' for env 'python'"},
+		{"GET", "/data/python/Dockerfile", http.StatusNotFound, "invalid sample 'Dockerfile' for env 'python'"},
+		{"GET", "/data/python/..", http.StatusNotFound, "invalid sample '..' for env 'python'"},
+		{"GET", "/data/python/../config.json", http.StatusBadRequest, "expected /data/<env>/<sample>[/input]"},
+		{"GET", "/data/python/%2e%2e%2fconfig.json", http.StatusBadRequest, "expected /data/<env>/<sample>[/input]"},
+		{"GET", "/data/python/%2e%2e", http.StatusNotFound, "invalid sample '..' for env 'python'"},
+		{"GET", "/data/../envs/python/hello", http.StatusBadRequest, "expected /data/<env>/<sample>[/input]"},
+		{"GET", "/data/java/hello", http.StatusNotFound, "invalid env 'java'"},
+		{"GET", "/data/python/gone", http.StatusNotFound, "file of sample 'gone' is missing"},
+		{"POST", "/data/python/hello", http.StatusMethodNotAllowed, "method POST not allowed"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		dataHandler(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.code || w.Body.String() != test.body {
+			t.Errorf("%s %s = %d %q, want %d %q", test.method, test.path, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+	w := httptest.NewRecorder()
+	dataHandler(w, httptest.NewRequest("GET", "/data/python/logo", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type of a binary sample = %q, want application/octet-stream", ct)
+	}
+	w = httptest.NewRecorder()
+	dataHandler(w, httptest.NewRequest("GET", "/data/python/hello", nil))
+	etag := w.Header().Get("ETag")
+	r := httptest.NewRequest("GET", "/data/python/hello", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	dataHandler(w, r)
+	if etag == "" || w.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag %q = %d, want %d", etag, w.Code, http.StatusNotModified)
+	}
+}
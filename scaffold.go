@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// scaffold holds what a template needs to generate a new env.
+type scaffold struct {
+	ID       string
+	Name     string
+	Mode     string
+	File     string
+	Image    string
+	Run      string
+	Template string
+}
+
+func (s scaffold) ext() string {
+	return filepath.Ext(s.File)
+}
+
+// idPattern is what the ID of a new env may be, as it names its directory
+// and images.
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// create writes the Dockerfile, config.json and Hello World sample of a new
+// env under p.Envs, from the template files found in p.Templates.
+func (s scaffold) create(p envPaths) error {
+	if !idPattern.MatchString(s.ID) {
+		return fmt.Errorf("invalid env ID '%s': use lowercase letters, digits, - and _", s.ID)
+	}
+	tmpl := filepath.Join(p.Templates, s.Template)
+	if _, err := os.Stat(filepath.Join(tmpl, "config.json")); err != nil {
+		return fmt.Errorf("invalid template '%s'", s.Template)
+	}
+	dir := filepath.Join(p.Envs, s.ID)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+	dockerfile, err := template.ParseFiles(filepath.Join(tmpl, "Dockerfile.tmpl"))
+	if err != nil {
+		return err
+	}
+	hello, err := ioutil.ReadFile(filepath.Join(tmpl, "hello", strings.TrimPrefix(s.ext(), ".")))
+	if os.IsNotExist(err) {
+		hello, err = []byte("Hello World!\n"), nil
+	}
+	if err != nil {
+		return err
+	}
+	helloFile := "hello_world" + s.ext()
+	config, err := json.MarshalIndent(map[string]interface{}{
+		"extends": templatePrefix + s.Template,
+		"name":    s.Name,
+		"mode":    s.Mode,
+		"file":    s.File,
+		"samples": []map[string]string{{"name": "Hello World", "file": helloFile}},
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := map[string][]byte{"config.json": append(config, '\n'), helloFile: hello}
+	if err := s.write(dir, dockerfile, files); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// write writes the Dockerfile of the env to dir from its template, then the
+// other files of the env.
+func (s scaffold) write(dir string, dockerfile *template.Template, files map[string][]byte) error {
+	f, err := os.Create(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := dockerfile.Execute(f, s); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scaffoldCommand(args []string) int {
+	p := defaultPaths
+	s := scaffold{}
+	flags := flag.NewFlagSet("envs new", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dtc envs new [flags] <id>")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&s.Template, "template", "default", "template the env is created from and extends")
+	flags.StringVar(&s.Name, "name", "", "name shown to students (default <id>)")
+	flags.StringVar(&s.Mode, "mode", "", "Ace editor mode (default <id>)")
+	flags.StringVar(&s.File, "file", "", "file the code is written to, e.g. main.rs")
+	flags.StringVar(&s.Image, "image", "", "base image, e.g. rust:1.75")
+	flags.StringVar(&s.Run, "run", "", "command running the code, e.g. \"rustc -o main main.rs && ./main\"")
+	flags.StringVar(&p.Envs, "envs", p.Envs, "directory of the envs")
+	flags.StringVar(&p.Templates, "templates", p.Templates, "directory of the env templates")
+	flags.StringVar(&p.Front, "front", p.Front, "directory of the front end")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || s.File == "" || s.Image == "" || s.Run == "" {
+		flags.Usage()
+		return 2
+	}
+	s.ID = flags.Arg(0)
+	if s.Name == "" {
+		s.Name = s.ID
+	}
+	if s.Mode == "" {
+		s.Mode = s.ID
+	}
+	if err := s.create(p); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	dir := filepath.Join(p.Envs, s.ID)
+	if _, errs := loadEnv(dir, p); len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, lintErrors(errs))
+		os.RemoveAll(dir)
+		return 1
+	}
+	fmt.Printf("Created %s\n", dir)
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// killGrace is how long killed runs are given to clean up after themselves,
+// and servers to close their connections, once the shutdown timeout is over.
+const killGrace = 10 * time.Second
+
+// shutdown stops the server: new connections and runs are refused, the runs
+// in progress are given timeout to finish, then the remaining ones are
+// killed and their workspaces removed.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	active := runs.close()
+	msg := fmt.Sprintf("The server is shutting down: this run will be killed if it is not over in %s.", timeout)
+	for _, r := range active {
+		r.info(msg)
+	}
+	// Handlers streaming runs return once the runs are over, so closing the
+	// servers only completes after them.
+	closed := make(chan struct{})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout+killGrace)
+		defer cancel()
+		wg := sync.WaitGroup{}
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				if err := server.Shutdown(ctx); err != nil {
+					server.Close()
+				}
+			}(server)
+		}
+		wg.Wait()
+		close(closed)
+	}()
+	if left := waitRuns(active, timeout); len(left) > 0 {
+		for _, r := range left {
+			slog.Warn("killing run", "run", r.ID)
+			r.cancel()
+		}
+		for _, r := range waitRuns(left, killGrace) {
+			r.mu.Lock()
+			dir := r.workdir
+			r.mu.Unlock()
+			slog.Error("run did not stop", "run", r.ID, "workdir", dir)
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
+		}
+	}
+	<-closed
+	slog.Info("server stopped")
+}
+
+// waitRuns waits for the runs to be over for at most timeout, and returns
+// those which are not.
+func waitRuns(list []*run, timeout time.Duration) []*run {
+	expired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		close(expired)
+	})
+	defer timer.Stop()
+	left := []*run{}
+	for _, r := range list {
+		if !r.wait(expired) {
+			left = append(left, r)
+		}
+	}
+	return left
+}
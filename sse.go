@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssePing is how often a comment is sent on idle streams so that proxies do
+// not close them.
+const ssePing = 15 * time.Second
+
+// sseHandler is the Server-Sent Events alternative to the /run/ websocket,
+// for networks that break websocket upgrades. POST /sse/ with the request
+// starts a run and returns its ID, then GET /sse/<id> streams the same
+// messages as the websocket, each with its sequence number as event ID so
+// that the browser resumes from Last-Event-ID when it reconnects. The stream
+// ends with an "end" event.
+func sseHandler(w http.ResponseWriter, r *http.Request) {
+	ID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sse"), "/")
+	if ID == "" {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		req := request{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %v", err))
+			return
+		}
+		if err := req.check(); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		run := runs.start(req)
+		w.Header().Set("Location", "/sse/"+run.ID)
+		writeJSON(w, http.StatusCreated, map[string]string{"id": run.ID})
+		return
+	}
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	run, ok := findRun(w, ID)
+	if !ok {
+		return
+	}
+	seq := 0
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.FormValue("lastEventId")
+	}
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("invalid event ID '%s'", last))
+			return
+		}
+		seq = n
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	ping := time.NewTicker(ssePing)
+	defer ping.Stop()
+	for {
+		events, done, update := run.follow(seq)
+		for _, e := range events {
+			seq = e.Seq
+			msg, ok := eventMessage(e)
+			if !ok {
+				fmt.Fprintf(w, "id: %d\n\n", e.Seq)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, msg)
+		}
+		if done {
+			fmt.Fprintf(w, "event: end\ndata:\n\n")
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+		select {
+		case <-update:
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}